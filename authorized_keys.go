@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// AuthorizedKeys is the set of client public keys a server accepts.
+// The file has one base64 key per line, optionally followed by a
+// comment, in the format written by keygen to the .pub file.
+type AuthorizedKeys struct {
+	keys map[[32]byte]bool
+}
+
+// NewAuthorizedKeys returns a set holding the given keys.
+func NewAuthorizedKeys(keys ...*[32]byte) *AuthorizedKeys {
+	ak := &AuthorizedKeys{make(map[[32]byte]bool)}
+	for _, key := range keys {
+		ak.keys[*key] = true
+	}
+	return ak
+}
+
+// LoadAuthorizedKeys reads the authorized keys file at path.
+func LoadAuthorizedKeys(path string) (*AuthorizedKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ak := NewAuthorizedKeys()
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := DecodeKey(strings.Fields(line)[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+		ak.keys[*key] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ak, nil
+}
+
+// Contains reports whether key is authorized.
+func (ak *AuthorizedKeys) Contains(key *[32]byte) bool {
+	return ak.keys[*key]
+}
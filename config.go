@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"golang.org/x/crypto/nacl/box"
+	"io"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// DefaultHandshakeTimeout is how long a server waits for a client
+// to complete the handshake, unless configured otherwise.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// Config holds the settings shared by Dial and Serve.
+// A nil Config is valid and behaves like an empty one.
+type Config struct {
+	// Long-term identity. If either key is nil, a fresh
+	// key pair is generated for every connection.
+	PublicKey  *[32]byte
+	PrivateKey *[32]byte
+
+	// If set, Dial verifies the server's key against these pinned
+	// keys. Unknown servers are pinned on first use, or refused if
+	// StrictHostKeyChecking is set.
+	KnownHosts            *KnownHosts
+	StrictHostKeyChecking bool
+
+	// If set, Serve only accepts clients whose key is in this set.
+	AuthorizedKeys *AuthorizedKeys
+
+	// The most data this end accepts in a single frame. It is sent to
+	// the peer during the handshake, and each end writes frames no larger
+	// than the other accepts. Defaults to DefaultMaxFrameSize, and is
+	// never less than MinFrameSize.
+	MaxFrameSize int
+
+	// If set, small writes are gathered into frames of up to this many
+	// bytes, which are sent when full or on EncryptedConnection.Flush.
+	// If FlushDelay is also set, buffered data is never held longer.
+	WriteBufferSize int
+	FlushDelay      time.Duration
+
+	// Handler serves each client once it is connected.
+	// Defaults to EchoHandler.
+	Handler Handler
+
+	// How long a server waits for a client to complete the handshake.
+	// Defaults to DefaultHandshakeTimeout; negative means forever.
+	HandshakeTimeout time.Duration
+
+	// If set, a server drops clients that send nothing for this long.
+	// It takes the place of any read deadline set on the connection.
+	IdleTimeout time.Duration
+
+	// If set, a server records metrics about its connections here.
+	Metrics *Metrics
+
+	// Hooks lets a server act on each connection as it is accepted,
+	// authenticated and closed.
+	Hooks Hooks
+
+	// Logger receives events such as handshakes, refused clients, bad
+	// frames and disconnects, tagged with the remote address and session
+	// id (see EncryptedConnection.SessionID). Defaults to discarding them.
+	Logger *slog.Logger
+}
+
+// keyPair returns the configured identity, or a new random one.
+func (c *Config) keyPair() (pub, priv *[32]byte, err error) {
+	if c != nil && c.PublicKey != nil && c.PrivateKey != nil {
+		return c.PublicKey, c.PrivateKey, nil
+	}
+	return box.GenerateKey(rand.Reader)
+}
+
+func (c *Config) maxFrameSize() int {
+	if c == nil || c.MaxFrameSize <= 0 {
+		return DefaultMaxFrameSize
+	}
+	if c.MaxFrameSize < MinFrameSize {
+		return MinFrameSize
+	}
+	// The size of a frame has to fit in its 4-byte header
+	if c.MaxFrameSize > math.MaxUint32-frameOverhead {
+		return math.MaxUint32 - frameOverhead
+	}
+	return c.MaxFrameSize
+}
+
+func (c *Config) writeBuffering() (int, time.Duration) {
+	if c == nil {
+		return 0, 0
+	}
+	return c.WriteBufferSize, c.FlushDelay
+}
+
+// discardLogger is used when Config.Logger isn't set.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func (c *Config) logger() *slog.Logger {
+	if c == nil || c.Logger == nil {
+		return discardLogger
+	}
+	return c.Logger
+}
+
+func (c *Config) metrics() *Metrics {
+	if c == nil {
+		return nil
+	}
+	return c.Metrics
+}
+
+func (c *Config) hooks() Hooks {
+	if c == nil {
+		return Hooks{}
+	}
+	return c.Hooks
+}
+
+func (c *Config) handler() Handler {
+	if c == nil || c.Handler == nil {
+		return EchoHandler
+	}
+	return c.Handler
+}
+
+func (c *Config) handshakeTimeout() time.Duration {
+	if c == nil || c.HandshakeTimeout == 0 {
+		return DefaultHandshakeTimeout
+	}
+	return c.HandshakeTimeout
+}
+
+func (c *Config) idleTimeout() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return c.IdleTimeout
+}
@@ -1,30 +1,244 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"io"
+	"log/slog"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
+// EncryptedConnection is a net.Conn that encrypts everything
+// sent over the underlying connection.
+//
+// Deadlines apply to the underlying connection. A read that times out
+// part way through a frame can be retried, and picks up where it left
+// off. A write that times out part way through a frame leaves the
+// connection unusable for writing, as the frame can't be taken back.
+// On servers with an idle timeout, each read sets its own deadline.
+//
+// One goroutine may read while any number of others write: each Write
+// is sent whole, without interleaving with other writers. Concurrent
+// reads are not supported.
+//
+// If Config.WriteBufferSize is set, writes are buffered: call Flush
+// once a message is complete. Close sends whatever is left.
 type EncryptedConnection struct {
-	conn net.Conn
-	sw   io.Writer
-	sr   io.Reader
+	conn    net.Conn
+	sw      *SecureWriter
+	sr      *SecureReader
+	caps    Capabilities
+	peerKey *[32]byte
+
+	// For logging, see setSession
+	sessionID string
+	logger    *slog.Logger
+	connected time.Time
+	closed    atomic.Bool
+
+	handshakeDuration time.Duration
+
+	// Server side only, see Config.Metrics and Config.Hooks
+	metrics *Metrics
+	ctx     context.Context
+	onClose func(*EncryptedConnection, ConnStats)
+
+	// Server side only, see Config.IdleTimeout
+	idleTimeout time.Duration
+	stats       *serverStats
+}
+
+var _ net.Conn = (*EncryptedConnection)(nil)
+
+// NewEncryptedConnection sets up an encrypted connection without a
+// handshake, from keys already exchanged. Both directions share one
+// key, so the reader refuses any frames the writer sent.
+func NewEncryptedConnection(conn net.Conn, priv, pub *[32]byte) *EncryptedConnection {
+	sw := newSecureWriter(conn, priv, pub, DefaultMaxFrameSize, directionNone)
+	sr := newSecureReader(conn, priv, pub, DefaultMaxFrameSize, directionNone)
+	sr.own = sw
+	return &EncryptedConnection{conn: conn, sw: sw, sr: sr, peerKey: pub, logger: discardLogger, connected: time.Now()}
+}
+
+// newClientConnection and newServerConnection set up the two ends of a
+// connection, so that the nonces of each direction can never collide.
+// Frames read may carry up to readMax bytes, and those written up to writeMax.
+func newClientConnection(conn net.Conn, priv, pub *[32]byte, readMax, writeMax int) *EncryptedConnection {
+	sw := newSecureWriter(conn, priv, pub, writeMax, directionClientToServer)
+	sr := newSecureReader(conn, priv, pub, readMax, directionServerToClient)
+	return &EncryptedConnection{conn: conn, sw: sw, sr: sr, logger: discardLogger, connected: time.Now()}
+}
+
+func newServerConnection(conn net.Conn, priv, pub *[32]byte, readMax, writeMax int) *EncryptedConnection {
+	sw := newSecureWriter(conn, priv, pub, writeMax, directionServerToClient)
+	sr := newSecureReader(conn, priv, pub, readMax, directionClientToServer)
+	return &EncryptedConnection{conn: conn, sw: sw, sr: sr, logger: discardLogger, connected: time.Now()}
+}
+
+// setSession names the connection after the handshake that set it up,
+// so that both ends log it under the same id.
+func (ec *EncryptedConnection) setSession(transcript []byte, config *Config) {
+	ec.sessionID = hex.EncodeToString(transcript[:8])
+	ec.logger = config.logger().With("remote", ec.conn.RemoteAddr().String(), "session", ec.sessionID)
+}
+
+// setMetrics records the connection in m until it is closed.
+func (ec *EncryptedConnection) setMetrics(m *Metrics) {
+	ec.metrics = m
+	ec.sr.observe = m.frameRead
+	ec.sw.observe = m.frameWritten
+	m.active.Add(1)
+}
+
+// SessionID returns an id for the connection that both ends agree on,
+// for matching up their logs. It is empty without a handshake.
+func (ec *EncryptedConnection) SessionID() string {
+	return ec.sessionID
+}
+
+// Context returns the context attached to the connection by
+// Hooks.OnHandshake, or the background context if there isn't one.
+func (ec *EncryptedConnection) Context() context.Context {
+	if ec.ctx == nil {
+		return context.Background()
+	}
+	return ec.ctx
+}
+
+// Stats returns counts of what the connection has transferred so far.
+// It is safe to call while the connection is in use.
+func (ec *EncryptedConnection) Stats() ConnStats {
+	return ConnStats{
+		BytesSent:         ec.sw.bytesWritten.Load(),
+		BytesReceived:     ec.sr.bytesRead.Load(),
+		WireBytesSent:     ec.sw.wireBytesWritten.Load(),
+		WireBytesReceived: ec.sr.wireBytesRead.Load(),
+		FramesSent:        ec.sw.framesWritten.Load(),
+		FramesReceived:    ec.sr.framesRead.Load(),
+		DecryptFailures:   ec.sr.decryptFailures.Load(),
+		HandshakeDuration: ec.handshakeDuration,
+		Age:               time.Since(ec.connected),
+	}
 }
 
-func NewEncryptedConnection(conn net.Conn, priv, pub *[32]byte) io.ReadWriteCloser {
-	sw := NewSecureWriter(conn, priv, pub)
-	sr := NewSecureReader(conn, priv, pub)
-	return &EncryptedConnection{conn, sw, sr}
+// Capabilities returns the protocol features negotiated during the handshake.
+func (ec *EncryptedConnection) Capabilities() Capabilities {
+	return ec.caps
+}
+
+// PeerPublicKey returns the long-term public key the peer
+// authenticated with during the handshake.
+func (ec *EncryptedConnection) PeerPublicKey() *[32]byte {
+	key := *ec.peerKey
+	return &key
 }
 
 func (ec *EncryptedConnection) Read(out []byte) (int, error) {
-	return ec.sr.Read(out)
+	ec.startRead()
+	n, err := ec.sr.Read(out)
+	ec.endRead(err)
+	return n, err
 }
 
 func (ec *EncryptedConnection) Write(message []byte) (int, error) {
 	return ec.sw.Write(message)
 }
 
+// ReadMessage and WriteMessage keep message boundaries, see
+// SecureReader.ReadMessage and SecureWriter.WriteMessage. They
+// can be mixed with Read and Write.
+func (ec *EncryptedConnection) ReadMessage() ([]byte, error) {
+	ec.startRead()
+	message, err := ec.sr.ReadMessage()
+	ec.endRead(err)
+	return message, err
+}
+
+func (ec *EncryptedConnection) WriteMessage(message []byte) error {
+	return ec.sw.WriteMessage(message)
+}
+
+// WriteTo and ReadFrom let io.Copy pass whole frames straight to and
+// from the connection, instead of through a buffer of its own.
+func (ec *EncryptedConnection) WriteTo(w io.Writer) (int64, error) {
+	return ec.sr.writeTo(w, func() error {
+		ec.startRead()
+		err := ec.sr.fill()
+		ec.endRead(err)
+		return err
+	})
+}
+
+func (ec *EncryptedConnection) ReadFrom(r io.Reader) (int64, error) {
+	return ec.sw.ReadFrom(r)
+}
+
+// startRead and endRead enforce the idle timeout around each read.
+func (ec *EncryptedConnection) startRead() {
+	if ec.idleTimeout > 0 {
+		ec.conn.SetReadDeadline(time.Now().Add(ec.idleTimeout))
+	}
+}
+
+func (ec *EncryptedConnection) endRead(err error) {
+	if ec.idleTimeout > 0 && isTimeout(err) {
+		ec.stats.idleTimeouts.Add(1)
+	}
+
+	// Anything wrong with the frames themselves is worth knowing about
+	if errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrReplayed) || errors.Is(err, ErrFrameTooLarge) || errors.Is(err, ErrTruncatedFrame) {
+		ec.logger.Warn("bad frame from peer", "err", err)
+	}
+	if ec.metrics != nil && errors.Is(err, ErrAuthFailed) {
+		ec.metrics.decryptFailures.Add(1)
+	}
+}
+
+// Flush sends any buffered writes, see Config.WriteBufferSize.
+func (ec *EncryptedConnection) Flush() error {
+	return ec.sw.Flush()
+}
+
+// Close sends anything still buffered before closing the connection,
+// giving up after closeFlushTimeout if the peer isn't reading. It
+// doesn't wait for a Write in progress, which fails instead.
 func (ec *EncryptedConnection) Close() error {
-	return ec.conn.Close()
+	err := ec.sw.close(ec.conn)
+	if ec.closed.CompareAndSwap(false, true) {
+		stats := ec.Stats()
+		ec.logger.Info("connection closed",
+			"bytes_read", stats.BytesReceived,
+			"bytes_written", stats.BytesSent,
+			"duration", stats.Age)
+		if ec.metrics != nil {
+			ec.metrics.active.Add(-1)
+		}
+		if ec.onClose != nil {
+			ec.onClose(ec, stats)
+		}
+	}
+	return err
+}
+
+func (ec *EncryptedConnection) LocalAddr() net.Addr {
+	return ec.conn.LocalAddr()
+}
+
+func (ec *EncryptedConnection) RemoteAddr() net.Addr {
+	return ec.conn.RemoteAddr()
+}
+
+func (ec *EncryptedConnection) SetDeadline(t time.Time) error {
+	return ec.conn.SetDeadline(t)
+}
+
+func (ec *EncryptedConnection) SetReadDeadline(t time.Time) error {
+	return ec.conn.SetReadDeadline(t)
+}
+
+func (ec *EncryptedConnection) SetWriteDeadline(t time.Time) error {
+	return ec.conn.SetWriteDeadline(t)
 }
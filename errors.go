@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by this package fall into a few classes, which can be
+// told apart with errors.Is:
+//
+//   ErrHandshake       the peers couldn't agree to talk, see also
+//                      ErrBadMagic, ErrBadHello, ErrFrameSizeTooSmall,
+//                      ErrHandshakeProof and *VersionError
+//   ErrHostKey         the server's key isn't the one expected, see
+//                      *UnknownHostError and *HostKeyMismatchError
+//   ErrAuthFailed      a frame was tampered with, or sealed with another key
+//   ErrReplayed        a genuine frame turned up in the wrong place,
+//                      see *SequenceError
+//   ErrFrameTooLarge   the peer sent a frame larger than allowed
+//   ErrTruncatedFrame  the stream ended part way through a frame, or
+//                      a frame is too short to be valid
+//
+// A peer that hangs up with a reason gives a *RemoteError. Errors from
+// the underlying connection, such as timeouts, are returned as they are.
+var (
+	ErrHandshake      = errors.New("handshake failed")
+	ErrHostKey        = errors.New("host key verification failed")
+	ErrAuthFailed     = errors.New("message authentication failed")
+	ErrReplayed       = errors.New("frame replayed or reflected")
+	ErrFrameTooLarge  = errors.New("frame too large")
+	ErrTruncatedFrame = errors.New("truncated frame")
+)
+
+// ErrBadMagic is returned when the peer doesn't speak this protocol.
+var ErrBadMagic = fmt.Errorf("%w: peer is not speaking this protocol", ErrHandshake)
+
+// ErrBadHello is returned when the peer's hello is cut short.
+var ErrBadHello = fmt.Errorf("%w: malformed hello", ErrHandshake)
+
+// ErrFrameSizeTooSmall is returned when the peer asks for frames
+// smaller than MinFrameSize.
+var ErrFrameSizeTooSmall = fmt.Errorf("%w: peer's max frame size is too small", ErrHandshake)
+
+// ErrHandshakeProof is returned when the peer cannot prove it owns
+// the static key it presented.
+var ErrHandshakeProof = fmt.Errorf("%w: invalid identity proof", ErrHandshake)
+
+// ErrUnauthorized is the reason a server gives for refusing a client
+// whose key isn't in Config.AuthorizedKeys.
+var ErrUnauthorized = errors.New("client key not authorized")
+
+// ErrMessageTooLarge is returned by WriteMessage when a message
+// won't fit in a single frame.
+var ErrMessageTooLarge = errors.New("message too large for one frame")
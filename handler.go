@@ -0,0 +1,38 @@
+package main
+
+// A Handler serves a client once the handshake is done. peerKey is the
+// long-term public key the client authenticated with. The connection is
+// closed when ServeConn returns.
+type Handler interface {
+	ServeConn(conn *EncryptedConnection, peerKey *[32]byte)
+}
+
+// The HandlerFunc type is an adapter to allow the use of
+// ordinary functions as handlers.
+type HandlerFunc func(conn *EncryptedConnection, peerKey *[32]byte)
+
+// ServeConn calls f(conn, peerKey).
+func (f HandlerFunc) ServeConn(conn *EncryptedConnection, peerKey *[32]byte) {
+	f(conn, peerKey)
+}
+
+// EchoHandler sends everything a client writes straight back to it.
+var EchoHandler Handler = HandlerFunc(echo)
+
+func echo(conn *EncryptedConnection, peerKey *[32]byte) {
+	conn.WriteTo(flushWriter{conn})
+}
+
+// flushWriter flushes after every write, so that an echo
+// isn't held back when writes are buffered.
+type flushWriter struct {
+	conn *EncryptedConnection
+}
+
+func (w flushWriter) Write(p []byte) (int, error) {
+	n, err := w.conn.Write(p)
+	if err == nil {
+		err = w.conn.Flush()
+	}
+	return n, err
+}
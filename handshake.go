@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/nacl/box"
+	"io"
+	"net"
+	"time"
+)
+
+// The handshake authenticates both long-term (static) keys, but the
+// session itself is encrypted with per-connection ephemeral keys, so
+// recorded traffic stays secret even if a static key later leaks.
+//
+//   server -> client: server hello
+//   client -> server: client hello | client static key | client proof
+//   server -> client: server static key | server proof
+//
+// Each of these is sent as a handshake message, framed like encrypted
+// messages so that a peer giving up can send an error frame instead:
+//   message = | 4-byte little-endian uint32 for size | 1-byte type | body |
+//   hello   = | 4-byte magic | 1-byte version | 4-byte little-endian capabilities |
+//             | 4-byte little-endian max frame size | ephemeral key |
+//
+// The max frame size is the most data the sender will accept in one
+// frame, so each side writes frames no larger than the other can read.
+//
+// A proof is a hash of both hellos, sealed with the sender's static
+// private key for the receiver's ephemeral key. Only the owner of the
+// static key can produce it, and it is bound to this session and to
+// the negotiated version and capabilities.
+//
+// Version 2 switched frames from random to sequence-numbered nonces.
+// Version 3 framed the handshake messages.
+// Version 4 added the max frame size to the hello.
+const (
+	protocolVersion = 4
+	helloSize       = 4 + 1 + 4 + 4 + 32
+	proofSize       = sha256.Size + box.Overhead
+)
+
+// Handshake message types
+const (
+	msgServerHello = 1
+	msgClientHello = 2
+	msgServerProof = 3
+
+	maxHandshakeMessageSize = 1024
+)
+
+var handshakeMagic = [4]byte{'g', 'c', '2', 'h'}
+
+var (
+	clientProofNonce = &[24]byte{'c'}
+	serverProofNonce = &[24]byte{'s'}
+)
+
+// Capabilities is a set of optional protocol features.
+// Each side advertises what it supports in its hello, and
+// the connection uses the features both sides have in common.
+type Capabilities uint32
+
+// supportedCapabilities is what this implementation advertises.
+// No optional features are defined yet.
+const supportedCapabilities Capabilities = 0
+
+// Has reports whether all the features in c2 are in c.
+func (c Capabilities) Has(c2 Capabilities) bool {
+	return c&c2 == c2
+}
+
+// VersionError is returned when the peer speaks an incompatible
+// version of the protocol.
+type VersionError struct {
+	Local, Remote uint8
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("handshake failed: incompatible protocol version %d (we speak %d)", e.Remote, e.Local)
+}
+
+func (e *VersionError) Is(target error) bool {
+	return target == ErrHandshake
+}
+
+type hello struct {
+	version      uint8
+	capabilities Capabilities
+	maxFrameSize uint32
+	ephemeral    [32]byte
+}
+
+func newHello(maxFrameSize int) (*hello, *[32]byte, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &hello{protocolVersion, supportedCapabilities, uint32(maxFrameSize), *pub}, priv, nil
+}
+
+func (h *hello) marshal() []byte {
+	buf := make([]byte, helloSize)
+	copy(buf[0:4], handshakeMagic[:])
+	buf[4] = h.version
+	binary.LittleEndian.PutUint32(buf[5:9], uint32(h.capabilities))
+	binary.LittleEndian.PutUint32(buf[9:13], h.maxFrameSize)
+	copy(buf[13:], h.ephemeral[:])
+	return buf
+}
+
+// unmarshalHello checks the magic and version before anything else,
+// as nothing else can be trusted to make sense if they are wrong.
+func unmarshalHello(buf []byte) (*hello, error) {
+	if len(buf) < 5 || !bytes.Equal(buf[0:4], handshakeMagic[:]) {
+		return nil, ErrBadMagic
+	}
+	if buf[4] != protocolVersion {
+		return nil, &VersionError{protocolVersion, buf[4]}
+	}
+	if len(buf) < helloSize {
+		return nil, ErrBadHello
+	}
+	h := &hello{
+		version:      buf[4],
+		capabilities: Capabilities(binary.LittleEndian.Uint32(buf[5:9])),
+		maxFrameSize: binary.LittleEndian.Uint32(buf[9:13]),
+	}
+	if h.maxFrameSize < MinFrameSize {
+		return nil, ErrFrameSizeTooSmall
+	}
+	copy(h.ephemeral[:], buf[13:helloSize])
+	return h, nil
+}
+
+// writeHandshakeMessage sends body as a handshake message of the given type,
+// in a single write.
+func writeHandshakeMessage(w io.Writer, msgType byte, body []byte) error {
+	buf := make([]byte, 5+len(body))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(1+len(body)))
+	buf[4] = msgType
+	copy(buf[5:], body)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readHandshakeMessage reads a whole handshake message, which must be of
+// the given type, and returns its body. If the peer sent an error frame
+// instead, the error is a *RemoteError.
+func readHandshakeMessage(r io.Reader, msgType byte) ([]byte, error) {
+	var header [5]byte
+	_, err := io.ReadFull(r, header[:4])
+	if err == io.ErrUnexpectedEOF {
+		return nil, ErrTruncatedFrame
+	}
+	if err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[:4])
+	if size == errorFrameMarker {
+		return nil, readErrorFrame(r)
+	}
+	if size < 1 || size > maxHandshakeMessageSize {
+		return nil, ErrBadMagic
+	}
+
+	_, err = io.ReadFull(r, header[4:])
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	if header[4] != msgType {
+		return nil, ErrBadMagic
+	}
+	body := make([]byte, size-1)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	return body, nil
+}
+
+// noEOF is for reads part way through a frame, where
+// the stream ending means the frame was cut short.
+func noEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncatedFrame
+	}
+	return err
+}
+
+// clientHandshake runs the client side of the handshake on conn, and
+// returns an encrypted connection along with the server's static key.
+func clientHandshake(conn net.Conn, config *Config) (*EncryptedConnection, *[32]byte, error) {
+	start := time.Now()
+
+	// Load or generate our long-term keys, and fresh ones for this session
+	staticPub, staticPriv, err := config.keyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	ours, ephPriv, err := newHello(config.maxFrameSize())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Read the server's hello, and tell it if we can't talk to it
+	serverHello, err := readHandshakeMessage(conn, msgServerHello)
+	if err != nil {
+		return nil, nil, err
+	}
+	theirs, err := unmarshalHello(serverHello)
+	if err != nil {
+		writeErrorFrame(conn, err.Error())
+		return nil, nil, err
+	}
+
+	// Send our hello and static key, and prove we own it
+	msg := ours.marshal()
+	msg = append(msg, staticPub[:]...)
+	transcript := transcriptHash(serverHello, msg)
+	msg = box.Seal(msg, transcript, clientProofNonce, &theirs.ephemeral, staticPriv)
+	err = writeHandshakeMessage(conn, msgClientHello, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Read the server's static key and check its proof
+	reply, err := readHandshakeMessage(conn, msgServerProof)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(reply) != 32+proofSize {
+		return nil, nil, ErrHandshakeProof
+	}
+	var peerStatic [32]byte
+	copy(peerStatic[:], reply[:32])
+	if !openProof(reply[32:], transcript, serverProofNonce, &peerStatic, ephPriv) {
+		return nil, nil, ErrHandshakeProof
+	}
+
+	ec := newClientConnection(conn, ephPriv, &theirs.ephemeral, config.maxFrameSize(), writeFrameSize(config, theirs))
+	ec.sw.setBuffering(config.writeBuffering())
+	ec.caps = ours.capabilities & theirs.capabilities
+	ec.peerKey = &peerStatic
+	ec.setSession(transcript, config)
+	ec.handshakeDuration = time.Since(start)
+	return ec, &peerStatic, nil
+}
+
+// serverHandshake runs the server side of the handshake on conn, and
+// returns an encrypted connection along with the client's static key.
+// A client whose key isn't authorized gets ErrUnauthorized, along
+// with its key.
+func serverHandshake(conn net.Conn, config *Config) (*EncryptedConnection, *[32]byte, error) {
+	start := time.Now()
+
+	// Load or generate our long-term keys, and fresh ones for this session
+	staticPub, staticPriv, err := config.keyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	ours, ephPriv, err := newHello(config.maxFrameSize())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Send our hello
+	serverHello := ours.marshal()
+	err = writeHandshakeMessage(conn, msgServerHello, serverHello)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Read the client's hello, and tell it if we can't talk to it
+	msg, err := readHandshakeMessage(conn, msgClientHello)
+	if err != nil {
+		if err == ErrBadMagic {
+			writeErrorFrame(conn, err.Error())
+		}
+		return nil, nil, err
+	}
+	theirs, err := unmarshalHello(msg)
+	if err != nil {
+		writeErrorFrame(conn, err.Error())
+		return nil, nil, err
+	}
+
+	// Check the client's proof
+	if len(msg) != helloSize+32+proofSize {
+		writeErrorFrame(conn, ErrHandshakeProof.Error())
+		return nil, nil, ErrHandshakeProof
+	}
+	var peerStatic [32]byte
+	copy(peerStatic[:], msg[helloSize:helloSize+32])
+	transcript := transcriptHash(serverHello, msg[:helloSize+32])
+	if !openProof(msg[helloSize+32:], transcript, clientProofNonce, &peerStatic, ephPriv) {
+		writeErrorFrame(conn, ErrHandshakeProof.Error())
+		return nil, nil, ErrHandshakeProof
+	}
+
+	// Only let in clients we know about, and tell them why if not,
+	// before they get to think they are connected
+	if config != nil && config.AuthorizedKeys != nil && !config.AuthorizedKeys.Contains(&peerStatic) {
+		writeErrorFrame(conn, ErrUnauthorized.Error())
+		return nil, &peerStatic, ErrUnauthorized
+	}
+
+	// Send our static key, and prove we own it
+	reply := make([]byte, 0, 32+proofSize)
+	reply = append(reply, staticPub[:]...)
+	reply = box.Seal(reply, transcript, serverProofNonce, &theirs.ephemeral, staticPriv)
+	err = writeHandshakeMessage(conn, msgServerProof, reply)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ec := newServerConnection(conn, ephPriv, &theirs.ephemeral, config.maxFrameSize(), writeFrameSize(config, theirs))
+	ec.sw.setBuffering(config.writeBuffering())
+	ec.caps = ours.capabilities & theirs.capabilities
+	ec.peerKey = &peerStatic
+	ec.setSession(transcript, config)
+	ec.handshakeDuration = time.Since(start)
+	return ec, &peerStatic, nil
+}
+
+// writeFrameSize is the largest frame both we and the peer allow.
+func writeFrameSize(config *Config, theirs *hello) int {
+	if int64(theirs.maxFrameSize) < int64(config.maxFrameSize()) {
+		return int(theirs.maxFrameSize)
+	}
+	return config.maxFrameSize()
+}
+
+// transcriptHash covers everything sent in the clear during the
+// handshake, so a proof also vouches that none of it was tampered with.
+func transcriptHash(serverHello, clientHello []byte) []byte {
+	h := sha256.New()
+	h.Write(serverHello)
+	h.Write(clientHello)
+	return h.Sum(nil)
+}
+
+// openProof checks that proof was sealed over transcript by the owner of peerStatic.
+func openProof(proof, transcript []byte, nonce *[24]byte, peerStatic, ephPriv *[32]byte) bool {
+	opened, ok := box.Open(nil, proof, nonce, peerStatic, ephPriv)
+	return ok && bytes.Equal(opened, transcript)
+}
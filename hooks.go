@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"net"
+)
+
+// Hooks let a server act on the connections it accepts, say to keep an
+// audit trail or to refuse clients by rules of its own. Any of them may
+// be nil. OnAccept, OnHandshake and OnAuthFailure are called from the
+// goroutine handling the connection, so a slow hook only holds up that
+// one. OnClose is different, see below.
+type Hooks struct {
+	// OnAccept is called for each new connection, before the handshake.
+	// If it returns an error, the connection is dropped.
+	OnAccept func(remote net.Addr) error
+
+	// OnHandshake is called once a client has completed the handshake
+	// and been authorized, before it is handed to the Handler. If it
+	// returns an error, the client is refused with the error as the
+	// reason. Otherwise, the context it returns is the connection's
+	// Context, which can carry state for the rest of the session.
+	OnHandshake func(ctx context.Context, conn *EncryptedConnection) (context.Context, error)
+
+	// OnAuthFailure is called when a client fails the handshake,
+	// including by timing out, or when its key isn't authorized,
+	// in which case err is ErrUnauthorized.
+	OnAuthFailure func(remote net.Addr, err error)
+
+	// OnClose is called when a connection that OnHandshake accepted
+	// is closed, with its final Stats. It runs in whichever goroutine
+	// calls Close: usually the one handling the connection, but it may
+	// be the caller of Server.Close or Shutdown, while the Handler is
+	// still running. It is called once per connection.
+	OnClose func(conn *EncryptedConnection, stats ConnStats)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Key files hold a single base64-encoded 32-byte Curve25519 key.
+// The private key lives at path (readable only by its owner) and
+// the public key next to it at path + ".pub", ready to be shared.
+const publicKeySuffix = ".pub"
+
+// GenerateKeyFiles creates a new long-term key pair and writes it to disk.
+func GenerateKeyFiles(path string) (pub, priv *[32]byte, err error) {
+	pub, priv, err = box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// O_EXCL so we never clobber an existing identity
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = fmt.Fprintln(f, EncodeKey(priv))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = ioutil.WriteFile(path+publicKeySuffix, []byte(EncodeKey(pub)+"\n"), 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pub, priv, nil
+}
+
+// LoadKeyPair reads a private key file and derives its public key.
+func LoadKeyPair(path string) (pub, priv *[32]byte, err error) {
+	priv, err = readKeyFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub = new([32]byte)
+	curve25519.ScalarBaseMult(pub, priv)
+	return pub, priv, nil
+}
+
+// LoadPublicKey reads a public key file, as written by GenerateKeyFiles.
+func LoadPublicKey(path string) (*[32]byte, error) {
+	return readKeyFile(path)
+}
+
+// EncodeKey returns the text encoding of a key.
+func EncodeKey(key *[32]byte) string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// DecodeKey parses the text encoding of a key.
+func DecodeKey(s string) (*[32]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("invalid key length %d, expected 32", len(raw))
+	}
+	var key [32]byte
+	copy(key[:], raw)
+	return &key, nil
+}
+
+func readKeyFile(path string) (*[32]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := DecodeKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// UnknownHostError is returned by strict host key checking
+// when a server has never been seen before.
+type UnknownHostError struct {
+	Addr        string
+	Fingerprint string
+}
+
+func (e *UnknownHostError) Error() string {
+	return fmt.Sprintf("unknown host %s with key %s", e.Addr, e.Fingerprint)
+}
+
+func (e *UnknownHostError) Is(target error) bool {
+	return target == ErrHostKey
+}
+
+// HostKeyMismatchError is returned when a server presents a different
+// key than the one pinned for it, which may be a man-in-the-middle.
+type HostKeyMismatchError struct {
+	Addr     string
+	Expected string
+	Got      string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s: expected %s, got %s", e.Addr, e.Expected, e.Got)
+}
+
+func (e *HostKeyMismatchError) Is(target error) bool {
+	return target == ErrHostKey
+}
+
+// KnownHosts is a trust-on-first-use store of server key fingerprints.
+// The file has one entry per line:
+//   host:port SHA256:<fingerprint>
+type KnownHosts struct {
+	path  string
+	mu    sync.Mutex
+	hosts map[string]string
+}
+
+// LoadKnownHosts reads the known hosts file at path.
+// A missing file is treated as empty and is created on the first pin.
+func LoadKnownHosts(path string) (*KnownHosts, error) {
+	kh := &KnownHosts{path: path, hosts: make(map[string]string)}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return kh, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: malformed known host entry", path, lineno)
+		}
+		kh.hosts[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return kh, nil
+}
+
+// Check verifies the key presented by the server at addr. An unknown
+// host is pinned on first contact, unless strict is set, in which
+// case it is refused with an UnknownHostError.
+func (kh *KnownHosts) Check(addr string, key *[32]byte, strict bool) error {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	fingerprint := Fingerprint(key)
+	expected, ok := kh.hosts[addr]
+	if ok {
+		if expected != fingerprint {
+			return &HostKeyMismatchError{addr, expected, fingerprint}
+		}
+		return nil
+	}
+	if strict {
+		return &UnknownHostError{addr, fingerprint}
+	}
+
+	// First contact, so remember this key
+	f, err := os.OpenFile(kh.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s %s\n", addr, fingerprint)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	kh.hosts[addr] = fingerprint
+	return nil
+}
+
+// Fingerprint returns a short printable digest of a public key.
+func Fingerprint(key *[32]byte) string {
+	sum := sha256.Sum256(key[:])
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// listener wraps a net.Listener so that Accept hands out connections
+// that have already completed the server side of the handshake.
+//
+// Handshakes run in their own goroutines, so a slow or misbehaving
+// client can't hold up connections from anyone else, and a failed
+// handshake is simply dropped rather than returned from Accept.
+type listener struct {
+	net.Listener
+	config  *Config
+	stats   *serverStats
+	metrics *Metrics // may be nil
+	conns   chan *EncryptedConnection
+	done    chan struct{}
+	err     error
+}
+
+// NewListener returns a net.Listener whose Accept returns
+// *EncryptedConnection values, handshaking with config.
+func NewListener(inner net.Listener, config *Config) net.Listener {
+	return newListener(inner, config, &serverStats{})
+}
+
+func newListener(inner net.Listener, config *Config, stats *serverStats) *listener {
+	l := &listener{
+		Listener: inner,
+		config:   config,
+		stats:    stats,
+		metrics:  config.metrics(),
+		conns:    make(chan *EncryptedConnection),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// Listen announces on the local network address, like net.Listen,
+// and returns a listener for encrypted connections.
+func Listen(network, addr string, config *Config) (net.Listener, error) {
+	inner, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(inner, config), nil
+}
+
+// Accept waits for the next client to complete the handshake.
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case ec := <-l.conns:
+		return ec, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// acceptLoop retries temporary errors from the inner listener, such as
+// running out of file descriptors, backing off like net/http does. Any
+// other error stops it, and is returned by Accept from then on.
+func (l *listener) acceptLoop() {
+	var delay time.Duration
+	for {
+		// Wait for a connection.
+		conn, err := l.Listener.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay *= 2
+			}
+			if delay > time.Second {
+				delay = time.Second
+			}
+			l.config.logger().Warn("accept failed, retrying", "err", err, "delay", delay)
+			time.Sleep(delay)
+			continue
+		}
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		delay = 0
+
+		// Handshake in a new goroutine.
+		l.stats.accepted.Add(1)
+		if l.metrics != nil {
+			l.metrics.accepted.Add(1)
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *listener) handshake(conn net.Conn) {
+	hooks := l.config.hooks()
+	if hooks.OnAccept != nil {
+		if err := hooks.OnAccept(conn.RemoteAddr()); err != nil {
+			l.config.logger().Info("connection refused by OnAccept", "remote", conn.RemoteAddr(), "err", err)
+			conn.Close()
+			return
+		}
+	}
+
+	// Don't let clients that never finish the handshake tie up the server
+	var deadline time.Time
+	if timeout := l.config.handshakeTimeout(); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+		conn.SetDeadline(deadline)
+	}
+
+	// Exchange keys and set up an encrypted connection for this session
+	ec, peerStatic, err := serverHandshake(conn, l.config)
+	if err != nil {
+		if err == ErrUnauthorized {
+			l.config.logger().Warn("rejecting unauthorized client", "remote", conn.RemoteAddr(), "fingerprint", Fingerprint(peerStatic))
+			if l.metrics != nil {
+				l.metrics.unauthorized.Add(1)
+			}
+		} else if isTimeout(err) {
+			l.config.logger().Info("timed out waiting for handshake", "remote", conn.RemoteAddr())
+			l.stats.handshakeTimeouts.Add(1)
+			if l.metrics != nil {
+				l.metrics.handshakeTimeouts.Add(1)
+			}
+		} else {
+			l.config.logger().Info("handshake failed", "remote", conn.RemoteAddr(), "err", err)
+			l.stats.handshakeFailures.Add(1)
+			if l.metrics != nil {
+				l.metrics.handshakeFailures.Add(1)
+			}
+		}
+		if hooks.OnAuthFailure != nil {
+			hooks.OnAuthFailure(conn.RemoteAddr(), err)
+		}
+		conn.Close()
+		return
+	}
+	ec.idleTimeout = l.config.idleTimeout()
+	ec.stats = l.stats
+
+	// Let the application have its say, and attach state to the session
+	if hooks.OnHandshake != nil {
+		ctx, err := hooks.OnHandshake(ec.Context(), ec)
+		if err != nil {
+			ec.logger.Info("client refused by OnHandshake", "fingerprint", Fingerprint(peerStatic), "err", err)
+			ec.sw.writeClose(err.Error())
+			conn.Close()
+			return
+		}
+		if ctx != nil {
+			ec.ctx = ctx
+		}
+	}
+	ec.onClose = hooks.OnClose
+	ec.logger.Info("client connected", "fingerprint", Fingerprint(peerStatic), "handshake", ec.handshakeDuration)
+	if l.metrics != nil {
+		l.metrics.observeHandshake(ec.handshakeDuration)
+		ec.setMetrics(l.metrics)
+	}
+
+	// Hand it over, unless the listener was closed in the meantime. The
+	// handshake deadline still applies, so that connections can't pile
+	// up waiting for someone to call Accept.
+	conn.SetDeadline(time.Time{})
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case l.conns <- ec:
+	case <-l.done:
+		ec.Close()
+	case <-expired:
+		ec.logger.Info("timed out waiting for Accept")
+		ec.Close()
+	}
+}
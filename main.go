@@ -1,102 +1,161 @@
 package main
 
 import (
-	"crypto/rand"
+	"context"
 	"flag"
 	"fmt"
-	"golang.org/x/crypto/nacl/box"
 	"io"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"time"
 )
 
 // Dial generates a private/public key pair,
 // connects to the server, perform the handshake
 // and return a reader/writer.
 func Dial(addr string) (io.ReadWriteCloser, error) {
-	// Generate a pair of keys
-	pub, priv, err := box.GenerateKey(rand.Reader)
+	ec, err := DialWithConfig(addr, nil)
 	if err != nil {
-		log.Println("Error generating a key pair", err)
 		return nil, err
 	}
+	return ec, nil
+}
+
+// DialWithConfig is like Dial, but uses the identity from config
+// instead of generating a new key pair.
+func DialWithConfig(addr string, config *Config) (*EncryptedConnection, error) {
+	return DialContext(context.Background(), "tcp", addr, config)
+}
 
+// DialContext connects to the server at addr on the named network
+// ("tcp", "tcp6", "unix", etc.) and performs the handshake. If ctx is
+// cancelled or expires before the handshake completes, the connection
+// is dropped and the context's error is returned.
+func DialContext(ctx context.Context, network, addr string, config *Config) (*EncryptedConnection, error) {
 	// Connect to the server
-	conn, err := net.Dial("tcp", addr)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
 	if err != nil {
-		log.Println("Error connecting to server", err)
 		return nil, err
 	}
 
-	// Send client's public key to the server
-	_, err = conn.Write(pub[:])
+	// Hold the handshake to the context's deadline, and
+	// interrupt it straight away if the context is cancelled
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+
+	// Exchange keys and set up an encrypted connection for this session
+	ec, peerStatic, err := clientHandshake(conn, config)
+	close(stop)
+	if <-interrupted {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	// The deadline can fire before the context notices it has expired
+	if deadline, ok := ctx.Deadline(); ok && isTimeout(err) && !time.Now().Before(deadline) {
+		conn.Close()
+		return nil, context.DeadlineExceeded
+	}
 	if err != nil {
-		log.Println("Error sending public key to server", err)
+		conn.Close()
 		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
 
-	// Read the server's public key
-	var peerPub [32]byte
-	_, err = conn.Read(peerPub[:])
-	if err != nil {
-		log.Println("Error reading public key from server", err)
-		return nil, err
+	// Make sure we are talking to the server we expect
+	if config != nil && config.KnownHosts != nil {
+		err = config.KnownHosts.Check(addr, peerStatic, config.StrictHostKeyChecking)
+		if err != nil {
+			ec.logger.Warn("server key verification failed", "err", err)
+			conn.Close()
+			return nil, err
+		}
 	}
+	ec.logger.Info("connected to server", "fingerprint", Fingerprint(peerStatic), "handshake", ec.handshakeDuration)
 
-	// Create an encrypted connection that well encrypt all traffic using the exchanged keys
-	ec := NewEncryptedConnection(conn, priv, &peerPub)
 	return ec, nil
 }
 
 // Serve starts a secure echo server on the given listener.
 func Serve(l net.Listener) error {
-	for {
-		// Wait for a connection.
-		conn, err := l.Accept()
-		if err != nil {
-			return err
-		}
+	return ServeWithConfig(l, nil)
+}
 
-		// Handle the connection in a new goroutine.
-		go handleConnection(conn)
-	}
+// ServeWithConfig is like Serve, but uses the identity from config
+// instead of generating a new key pair for each connection, and hands
+// connections to config.Handler rather than echoing.
+func ServeWithConfig(l net.Listener, config *Config) error {
+	srv := &Server{Config: config}
+	return srv.Serve(l)
 }
 
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
+func handleConnection(ec *EncryptedConnection, handler Handler) {
+	defer ec.Close()
+	handler.ServeConn(ec, ec.PeerPublicKey())
+}
 
-	// Generate a pair of keys
-	pub, priv, err := box.GenerateKey(rand.Reader)
-	if err != nil {
-		log.Println("Error generating a key pair", err)
-		return
-	}
+func main() {
+	port := flag.Int("l", 0, "Listen mode. Specify port")
+	keyFile := flag.String("k", "", "Private key file to use as identity (see keygen)")
+	knownHostsFile := flag.String("known-hosts", "", "Known hosts file used to verify the server key")
+	strict := flag.Bool("strict", false, "Refuse servers that are not in the known hosts file")
+	authorizedKeysFile := flag.String("authorized-keys", "", "Only accept clients whose key is in this file")
+	metricsAddr := flag.String("metrics", "", "Serve Prometheus metrics over HTTP on this address, e.g. localhost:9100")
+	flag.Parse()
 
-	// Read the client's public key
-	var peerPub [32]byte
-	_, err = conn.Read(peerPub[:])
-	if err != nil {
-		log.Println("Error reading public key from client", err)
+	// Key generation mode
+	if flag.Arg(0) == "keygen" {
+		if flag.NArg() != 2 {
+			log.Fatalf("Usage: %s keygen <keyfile>", os.Args[0])
+		}
+		pub, _, err := GenerateKeyFiles(flag.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Wrote %s and %s%s\n", flag.Arg(1), flag.Arg(1), publicKeySuffix)
+		fmt.Printf("Public key: %s\n", EncodeKey(pub))
 		return
 	}
 
-	// Send server's public key to the client
-	_, err = conn.Write(pub[:])
-	if err != nil {
-		log.Println("Error sending public key to client", err)
-		return
+	config := &Config{}
+	if *keyFile != "" {
+		pub, priv, err := LoadKeyPair(*keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.PublicKey, config.PrivateKey = pub, priv
+	}
+	if *knownHostsFile != "" {
+		kh, err := LoadKnownHosts(*knownHostsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.KnownHosts = kh
+		config.StrictHostKeyChecking = *strict
+	}
+	if *authorizedKeysFile != "" {
+		ak, err := LoadAuthorizedKeys(*authorizedKeysFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.AuthorizedKeys = ak
 	}
-
-	// Create encrypted streams, and link them to echo results back to client
-	sr := NewSecureReader(conn, priv, &peerPub)
-	sw := NewSecureWriter(conn, priv, &peerPub)
-	io.Copy(sw, sr)
-}
-
-func main() {
-	port := flag.Int("l", 0, "Listen mode. Specify port")
-	flag.Parse()
 
 	// Server mode
 	if *port != 0 {
@@ -105,21 +164,49 @@ func main() {
 			log.Fatal(err)
 		}
 		defer l.Close()
-		log.Fatal(Serve(l))
+
+		// Serve metrics on the side, if asked to
+		if *metricsAddr != "" {
+			config.Metrics = NewMetrics()
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", config.Metrics)
+			go func() {
+				log.Fatal(http.ListenAndServe(*metricsAddr, mux))
+			}()
+		}
+
+		// Let clients finish up when we are asked to stop
+		config.Logger = slog.Default()
+		srv := &Server{Config: config}
+		drained := make(chan struct{})
+		go func() {
+			sigc := make(chan os.Signal, 1)
+			signal.Notify(sigc, os.Interrupt)
+			<-sigc
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			srv.Shutdown(ctx)
+			close(drained)
+		}()
+		if err := srv.Serve(l); err != ErrServerClosed {
+			log.Fatal(err)
+		}
+		<-drained
+		return
 	}
 
 	// Client mode
-	if len(os.Args) != 3 {
-		log.Fatalf("Usage: %s <port> <message>", os.Args[0])
+	if flag.NArg() != 2 {
+		log.Fatalf("Usage: %s [-k keyfile] <port> <message>", os.Args[0])
 	}
-	conn, err := Dial("localhost:" + os.Args[1])
+	conn, err := DialWithConfig("localhost:"+flag.Arg(0), config)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if _, err := conn.Write([]byte(os.Args[2])); err != nil {
+	if _, err := conn.Write([]byte(flag.Arg(1))); err != nil {
 		log.Fatal(err)
 	}
-	buf := make([]byte, len(os.Args[2]))
+	buf := make([]byte, len(flag.Arg(1)))
 	n, err := conn.Read(buf)
 	if err != nil {
 		log.Fatal(err)
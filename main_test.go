@@ -1,13 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/nacl/box"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestReadWriterPing(t *testing.T) {
@@ -161,15 +174,18 @@ func TestSecureDial(t *testing.T) {
 			}
 			go func(c net.Conn) {
 				defer c.Close()
-				key := [32]byte{}
-				c.Write(key[:])
+				if _, _, err := serverHandshake(c, nil); err != nil {
+					t.Error(err)
+					return
+				}
 				buf := make([]byte, 2048)
 				n, err := c.Read(buf)
 				if err != nil {
-					t.Fatal(err)
+					t.Error(err)
+					return
 				}
 				if got := string(buf[:n]); got == "hello world\n" {
-					t.Fatal("Unexpected result. Got raw data instead of encrypted")
+					t.Error("Unexpected result. Got raw data instead of encrypted")
 				}
 			}(conn)
 		}
@@ -471,3 +487,2082 @@ Suspendisse sit amet est efficitur lorem aliquam tincidunt. In hendrerit ligula
 		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
 	}
 }
+
+func TestKeyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "id")
+
+	pub, priv, err := GenerateKeyFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The private key must only be readable by its owner
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("Unexpected private key permissions: %o", perm)
+	}
+
+	// Loading gives back the same pair, with the public key derived from the private one
+	lpub, lpriv, err := LoadKeyPair(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *lpub != *pub || *lpriv != *priv {
+		t.Fatal("Loaded key pair doesn't match the generated one")
+	}
+	spub, err := LoadPublicKey(path + publicKeySuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *spub != *pub {
+		t.Fatal("Loaded public key doesn't match the generated one")
+	}
+
+	// Never overwrite an existing identity
+	if _, _, err := GenerateKeyFiles(path); err == nil {
+		t.Fatal("Expected an error when the key file already exists")
+	}
+}
+
+func TestSecureEchoServerWithConfig(t *testing.T) {
+	spub, spriv, _ := box.GenerateKey(rand.Reader)
+	cpub, cpriv, _ := box.GenerateKey(rand.Reader)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go ServeWithConfig(l, &Config{PublicKey: spub, PrivateKey: spriv})
+
+	conn, err := DialWithConfig(l.Addr().String(), &Config{PublicKey: cpub, PrivateKey: cpriv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expected := "hello world\n"
+	if _, err := fmt.Fprintf(conn, expected); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != expected {
+		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "known_hosts")
+
+	key1, _, _ := box.GenerateKey(rand.Reader)
+	key2, _, _ := box.GenerateKey(rand.Reader)
+
+	kh, err := LoadKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Strict mode refuses hosts we haven't seen
+	if err := kh.Check("example.com:1234", key1, true); err == nil {
+		t.Fatal("Expected strict mode to refuse an unknown host")
+	} else if _, ok := err.(*UnknownHostError); !ok {
+		t.Fatalf("Unexpected error type: %T", err)
+	}
+
+	// First contact pins the key
+	if err := kh.Check("example.com:1234", key1, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pin survives a reload, and a different key is refused
+	kh, err = LoadKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kh.Check("example.com:1234", key1, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := kh.Check("example.com:1234", key2, false); err == nil {
+		t.Fatal("Expected a host key mismatch")
+	} else if _, ok := err.(*HostKeyMismatchError); !ok {
+		t.Fatalf("Unexpected error type: %T", err)
+	}
+}
+
+func TestSecureDialKnownHostsMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go Serve(l)
+
+	// Pin some other key for the server's address
+	kh, err := LoadKnownHosts(filepath.Join(dir, "known_hosts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _ := box.GenerateKey(rand.Reader)
+	if err := kh.Check(l.Addr().String(), other, false); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = DialWithConfig(l.Addr().String(), &Config{KnownHosts: kh})
+	if _, ok := err.(*HostKeyMismatchError); !ok {
+		t.Fatalf("Expected a host key mismatch, got: %v", err)
+	}
+}
+
+func TestSecureServeAuthorizedKeys(t *testing.T) {
+	apub, apriv, _ := box.GenerateKey(rand.Reader)
+	bpub, bpriv, _ := box.GenerateKey(rand.Reader)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go ServeWithConfig(l, &Config{AuthorizedKeys: NewAuthorizedKeys(apub)})
+
+	// An authorized client gets its echo
+	conn, err := DialWithConfig(l.Addr().String(), &Config{PublicKey: apub, PrivateKey: apriv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "hello world\n"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Anyone else is told why during the handshake
+	_, err = DialWithConfig(l.Addr().String(), &Config{PublicKey: bpub, PrivateKey: bpriv})
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Reason != ErrUnauthorized.Error() {
+		t.Fatalf("Expected the dial to be refused, got: %v", err)
+	}
+}
+
+func TestLoadAuthorizedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authorized_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "authorized_keys")
+
+	apub, _, _ := box.GenerateKey(rand.Reader)
+	bpub, _, _ := box.GenerateKey(rand.Reader)
+	contents := "# allowed clients\n" + EncodeKey(apub) + " alice\n\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ak, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ak.Contains(apub) {
+		t.Fatal("Expected listed key to be authorized")
+	}
+	if ak.Contains(bpub) {
+		t.Fatal("Expected unlisted key not to be authorized")
+	}
+}
+
+func TestHandshakeStaticKeys(t *testing.T) {
+	spub, spriv, _ := box.GenerateKey(rand.Reader)
+	cpub, cpriv, _ := box.GenerateKey(rand.Reader)
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	// Each side learns the other's long-term key
+	done := make(chan error, 1)
+	go func() {
+		_, peer, err := serverHandshake(s, &Config{PublicKey: spub, PrivateKey: spriv})
+		if err == nil && *peer != *cpub {
+			err = fmt.Errorf("Server got the wrong client key")
+		}
+		done <- err
+	}()
+	_, peer, err := clientHandshake(c, &Config{PublicKey: cpub, PrivateKey: cpriv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *peer != *spub {
+		t.Fatal("Client got the wrong server key")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeImpersonation(t *testing.T) {
+	// The attacker knows the server's public key, but not its private key
+	spub, _, _ := box.GenerateKey(rand.Reader)
+	_, mpriv, _ := box.GenerateKey(rand.Reader)
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	go func() {
+		h, _, _ := newHello(DefaultMaxFrameSize)
+		serverHello := h.marshal()
+		writeHandshakeMessage(s, msgServerHello, serverHello)
+		msg, err := readHandshakeMessage(s, msgClientHello)
+		if err != nil {
+			return
+		}
+		clientHello, _ := unmarshalHello(msg)
+		transcript := transcriptHash(serverHello, msg[:helloSize+32])
+		reply := append([]byte{}, spub[:]...)
+		reply = box.Seal(reply, transcript, serverProofNonce, &clientHello.ephemeral, mpriv)
+		writeHandshakeMessage(s, msgServerProof, reply)
+	}()
+
+	_, _, err := clientHandshake(c, nil)
+	if err != ErrHandshakeProof {
+		t.Fatalf("Expected an invalid proof, got: %v", err)
+	}
+}
+
+func TestHandshakeVersionMismatch(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	// A server from the future, which the client tells why it is leaving
+	remote := make(chan error, 1)
+	go func() {
+		h, _, _ := newHello(DefaultMaxFrameSize)
+		h.version = protocolVersion + 1
+		writeHandshakeMessage(s, msgServerHello, h.marshal())
+		_, err := readHandshakeMessage(s, msgClientHello)
+		remote <- err
+	}()
+
+	_, _, err := clientHandshake(c, nil)
+	if verr, ok := err.(*VersionError); !ok || verr.Remote != protocolVersion+1 {
+		t.Fatalf("Expected a version error, got: %v", err)
+	}
+	if err := <-remote; err == nil {
+		t.Fatal("Expected the server to get an error")
+	} else if _, ok := err.(*RemoteError); !ok {
+		t.Fatalf("Expected a remote error, got: %v", err)
+	}
+}
+
+func TestSecureServeVersionMismatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Skip the server hello, and answer as a client from the future
+	if _, err := readHandshakeMessage(conn, msgServerHello); err != nil {
+		t.Fatal(err)
+	}
+	h, _, _ := newHello(DefaultMaxFrameSize)
+	h.version = protocolVersion + 1
+	if err := writeHandshakeMessage(conn, msgClientHello, h.marshal()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server explains why it is hanging up
+	_, err = readHandshakeMessage(conn, msgServerProof)
+	if _, ok := err.(*RemoteError); !ok {
+		t.Fatalf("Expected a remote error, got: %v", err)
+	}
+}
+
+// oneByteConn delivers data a single byte at a time in both directions,
+// like a network that splits everything into the smallest possible segments.
+type oneByteConn struct {
+	net.Conn
+}
+
+func (c oneByteConn) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return c.Conn.Read(p)
+}
+
+func (c oneByteConn) Write(p []byte) (int, error) {
+	for i := range p {
+		if _, err := c.Conn.Write(p[i : i+1]); err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+func TestHandshakeOneByteAtATime(t *testing.T) {
+	spub, spriv, _ := box.GenerateKey(rand.Reader)
+	cpub, cpriv, _ := box.GenerateKey(rand.Reader)
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	go func() {
+		ec, _, err := serverHandshake(oneByteConn{s}, &Config{PublicKey: spub, PrivateKey: spriv})
+		if err != nil {
+			return
+		}
+		io.Copy(ec, ec)
+	}()
+
+	ec, peer, err := clientHandshake(oneByteConn{c}, &Config{PublicKey: cpub, PrivateKey: cpriv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *peer != *spub {
+		t.Fatal("Client got the wrong server key")
+	}
+
+	expected := "hello world\n"
+	if _, err := fmt.Fprintf(ec, expected); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(ec, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != expected {
+		t.Fatalf("Unexpected result: %s != %s", got, expected)
+	}
+}
+
+func TestHandshakeGarbage(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	// A server that isn't speaking our protocol at all
+	go func() {
+		s.Write([]byte("SSH-2.0-OpenSSH_6.6\r\n"))
+		io.Copy(ioutil.Discard, s)
+	}()
+	if _, _, err := clientHandshake(c, nil); err != ErrBadMagic {
+		t.Fatalf("Expected a bad magic error, got: %v", err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	c := Capabilities(1<<0 | 1<<2)
+	if !c.Has(1<<0) || !c.Has(1<<0|1<<2) {
+		t.Fatal("Expected capabilities to be set")
+	}
+	if c.Has(1<<1) || c.Has(1<<0|1<<1) {
+		t.Fatal("Expected capabilities not to be set")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go Serve(l)
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if caps := conn.(*EncryptedConnection).Capabilities(); caps != supportedCapabilities {
+		t.Fatalf("Unexpected negotiated capabilities: %b", caps)
+	}
+}
+
+//
+// Benchmarks
+//
+
+func BenchmarkBoxSeal(b *testing.B) {
+	_, priv, _ := box.GenerateKey(rand.Reader)
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	nonce := &[24]byte{}
+	message := make([]byte, 64)
+	out := make([]byte, 0, len(message)+box.Overhead)
+
+	b.SetBytes(int64(len(message)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		box.Seal(out, message, nonce, pub, priv)
+	}
+}
+
+func BenchmarkBoxSealAfterPrecomputation(b *testing.B) {
+	_, priv, _ := box.GenerateKey(rand.Reader)
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	nonce := &[24]byte{}
+	message := make([]byte, 64)
+	out := make([]byte, 0, len(message)+box.Overhead)
+	var sharedKey [32]byte
+	box.Precompute(&sharedKey, pub, priv)
+
+	b.SetBytes(int64(len(message)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		box.SealAfterPrecomputation(out, message, nonce, &sharedKey)
+	}
+}
+
+func benchmarkReadWriter(b *testing.B, size int) {
+	_, priv, _ := box.GenerateKey(rand.Reader)
+	pub, _, _ := box.GenerateKey(rand.Reader)
+
+	r, w := io.Pipe()
+	secureR := NewSecureReader(r, priv, pub)
+	secureW := NewSecureWriter(w, priv, pub)
+
+	message := make([]byte, size)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			secureW.Write(message)
+		}
+		w.Close()
+	}()
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	buf := make([]byte, size)
+	for {
+		if _, err := io.ReadFull(secureR, buf); err != nil {
+			break
+		}
+	}
+}
+
+func BenchmarkReadWriter64(b *testing.B) {
+	benchmarkReadWriter(b, 64)
+}
+
+func BenchmarkReadWriter1K(b *testing.B) {
+	benchmarkReadWriter(b, 1024)
+}
+
+func BenchmarkReadWriter32K(b *testing.B) {
+	benchmarkReadWriter(b, 32*1024)
+}
+
+// splitFrames cuts the output of a SecureWriter into its frames.
+func splitFrames(buf []byte) [][]byte {
+	var frames [][]byte
+	for len(buf) > 0 {
+		size := int(binary.LittleEndian.Uint32(buf[0:4]))
+		frames = append(frames, buf[:4+size])
+		buf = buf[4+size:]
+	}
+	return frames
+}
+
+func TestSequencedFrames(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	var buf bytes.Buffer
+	secureW := NewSecureWriter(&buf, priv, pub)
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(secureW, "hello world %d\n", i)
+	}
+	frames := splitFrames(buf.Bytes())
+
+	tests := []struct {
+		name     string
+		order    []int
+		expected uint64
+		got      uint64
+	}{
+		{"replayed", []int{0, 1, 1}, 2, 1},
+		{"reordered", []int{0, 2, 1}, 1, 2},
+		{"dropped", []int{1, 2}, 0, 1},
+	}
+	for _, test := range tests {
+		var stream []byte
+		for _, i := range test.order {
+			stream = append(stream, frames[i]...)
+		}
+		_, err := ioutil.ReadAll(NewSecureReader(bytes.NewReader(stream), priv, pub))
+		serr, ok := err.(*SequenceError)
+		if !ok {
+			t.Fatalf("%s: expected a sequence error, got: %v", test.name, err)
+		}
+		if serr.Expected != test.expected || serr.Got != test.got {
+			t.Fatalf("%s: unexpected sequence error: %v", test.name, serr)
+		}
+	}
+}
+
+func TestReflectedFrames(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	// Frames sent by a client must not be accepted by another client
+	var buf bytes.Buffer
+	fmt.Fprintf(newSecureWriter(&buf, priv, pub, DefaultMaxFrameSize, directionClientToServer), "hello world\n")
+
+	_, err := newSecureReader(bytes.NewReader(buf.Bytes()), priv, pub, DefaultMaxFrameSize, directionServerToClient).Read(make([]byte, 1024))
+	if err == nil {
+		t.Fatal("Expected a reflected frame to be refused")
+	}
+
+	_, err = newSecureReader(bytes.NewReader(buf.Bytes()), priv, pub, DefaultMaxFrameSize, directionClientToServer).Read(make([]byte, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	// A huge size header is refused before anything is allocated
+	header := []byte{0xFF, 0xFF, 0xFF, 0x7F}
+	_, err := NewSecureReader(bytes.NewReader(header), priv, pub).Read(make([]byte, 1024))
+	if err != ErrFrameTooLarge {
+		t.Fatalf("Expected frame too large, got: %v", err)
+	}
+
+	// So is a size too small to hold a nonce
+	header = []byte{0x01, 0x00, 0x00, 0x00, 0x00}
+	_, err = NewSecureReader(bytes.NewReader(header), priv, pub).Read(make([]byte, 1024))
+	if err == nil {
+		t.Fatal("Expected a short frame to be refused")
+	}
+
+	// Large writes are split up into frames the reader will accept
+	var buf bytes.Buffer
+	message := bytes.Repeat([]byte("hello world\n"), 100)
+	n, err := NewSecureWriterSize(&buf, priv, pub, 100).Write(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(message) {
+		t.Fatalf("Unexpected write count: %d != %d", n, len(message))
+	}
+	if frames := splitFrames(buf.Bytes()); len(frames) != 12 {
+		t.Fatalf("Unexpected number of frames: %d", len(frames))
+	}
+	got, err := ioutil.ReadAll(NewSecureReaderSize(&buf, priv, pub, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, message) {
+		t.Fatal("Unexpected result after splitting frames")
+	}
+}
+
+// failingWriter accepts limit bytes, and then fails.
+type failingWriter struct {
+	limit int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > fw.limit {
+		n := fw.limit
+		fw.limit = 0
+		return n, io.ErrShortWrite
+	}
+	fw.limit -= len(p)
+	return len(p), nil
+}
+
+func TestLargeWriteChunking(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	r, w := io.Pipe()
+	secureR := NewSecureReader(r, priv, pub)
+	secureW := NewSecureWriter(w, priv, pub)
+
+	// The reader gets the first frame while the write is still going
+	message := make([]byte, 16*DefaultMaxFrameSize)
+	done := make(chan struct{})
+	go func() {
+		secureW.Write(message)
+		close(done)
+		w.Close()
+	}()
+
+	n, err := io.ReadFull(secureR, make([]byte, DefaultMaxFrameSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != DefaultMaxFrameSize {
+		t.Fatalf("Unexpected read count: %d", n)
+	}
+	select {
+	case <-done:
+		t.Fatal("Expected the write to still be in progress")
+	default:
+	}
+
+	rest, err := ioutil.ReadAll(secureR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n+len(rest) != len(message) {
+		t.Fatalf("Unexpected total read: %d != %d", n+len(rest), len(message))
+	}
+}
+
+func TestLargeWriteFailure(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	// Only the frames that made it out in full are counted
+	frameSize := 4 + frameOverhead + 100
+	secureW := NewSecureWriterSize(&failingWriter{2*frameSize + 10}, priv, pub, 100)
+	n, err := secureW.Write(make([]byte, 1000))
+	if err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+	if n != 200 {
+		t.Fatalf("Unexpected write count: %d != %d", n, 200)
+	}
+}
+
+func TestReadDeadlineMidFrame(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(NewSecureWriter(&buf, priv, pub), "hello world\n")
+	frame := buf.Bytes()
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	ec := NewEncryptedConnection(c, priv, pub)
+
+	// Only half the frame arrives before the deadline
+	go s.Write(frame[:len(frame)/2])
+	ec.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := ec.Read(make([]byte, 1024))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("Expected a timeout, got: %v", err)
+	}
+
+	// The next read carries on from where the last one stopped
+	go s.Write(frame[len(frame)/2:])
+	ec.SetReadDeadline(time.Time{})
+	out := make([]byte, 1024)
+	n, err := ec.Read(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(out[:n]); got != "hello world\n" {
+		t.Fatalf("Unexpected result: %s != %s", got, "hello world\n")
+	}
+}
+
+func TestEncryptedConnectionConn(t *testing.T) {
+	spub, spriv, _ := box.GenerateKey(rand.Reader)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go ServeWithConfig(l, &Config{PublicKey: spub, PrivateKey: spriv})
+
+	ec, err := DialWithConfig(l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ec.Close()
+
+	var conn net.Conn = ec
+	if conn.RemoteAddr().String() != l.Addr().String() {
+		t.Fatalf("Unexpected remote address: %s", conn.RemoteAddr())
+	}
+	if *ec.PeerPublicKey() != *spub {
+		t.Fatal("Unexpected peer public key")
+	}
+
+	// Nothing to read, so we should time out
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1024))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("Expected a timeout, got: %v", err)
+	}
+}
+
+func TestListener(t *testing.T) {
+	cpub, cpriv, _ := box.GenerateKey(rand.Reader)
+
+	l, err := Listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// A client that never finishes its handshake doesn't hold up the others
+	stalled, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	go func() {
+		conn, err := DialWithConfig(l.Addr().String(), &Config{PublicKey: cpub, PrivateKey: cpriv})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "hello world\n")
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ec, ok := conn.(*EncryptedConnection)
+	if !ok {
+		t.Fatalf("Unexpected connection type: %T", conn)
+	}
+	if *ec.PeerPublicKey() != *cpub {
+		t.Fatal("Unexpected peer public key")
+	}
+	buf := make([]byte, 1024)
+	n, err := ec.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "hello world\n" {
+		t.Fatalf("Unexpected result: %s != %s", got, "hello world\n")
+	}
+
+	// Once closed, Accept returns an error
+	l.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("Expected an error from a closed listener")
+	}
+}
+
+func TestServeHandler(t *testing.T) {
+	cpub, cpriv, _ := box.GenerateKey(rand.Reader)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Greet clients by their key
+	handler := HandlerFunc(func(conn *EncryptedConnection, peerKey *[32]byte) {
+		fmt.Fprintf(conn, "hello %s\n", EncodeKey(peerKey))
+	})
+	go ServeWithConfig(l, &Config{Handler: handler})
+
+	conn, err := DialWithConfig(l.Addr().String(), &Config{PublicKey: cpub, PrivateKey: cpriv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "hello " + EncodeKey(cpub) + "\n"
+	if got := string(buf); got != expected {
+		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Echo twice, then hang up
+	handler := HandlerFunc(func(conn *EncryptedConnection, peerKey *[32]byte) {
+		buf := make([]byte, 1024)
+		for i := 0; i < 2; i++ {
+			n, _ := conn.Read(buf)
+			conn.Write(buf[:n])
+		}
+	})
+	srv := &Server{Config: &Config{Handler: handler}}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Make sure the server has picked up the connection
+	buf := make([]byte, 1024)
+	fmt.Fprintf(conn, "hello world\n")
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+
+	// We stop accepting straight away, but the active client isn't cut off
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("Expected ErrServerClosed, got: %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the connection finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fmt.Fprintf(conn, "hello again\n")
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "hello again\n" {
+		t.Fatalf("Unexpected result: %s != %s", got, "hello again\n")
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+
+	// Serving again is refused
+	if err := srv.Serve(l); err != ErrServerClosed {
+		t.Fatalf("Expected ErrServerClosed, got: %v", err)
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{}
+	go srv.Serve(l)
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Make sure the server has picked up the connection
+	fmt.Fprintf(conn, "hello world\n")
+	if _, err := conn.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The echo client never hangs up, so it gets cut off
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the shutdown to time out, got: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1024)); err == nil {
+		t.Fatal("Expected the connection to be closed")
+	}
+}
+
+func TestDialContextTimeout(t *testing.T) {
+	// A server that accepts, but never says hello
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				io.Copy(ioutil.Discard, c)
+			}(conn)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = DialContext(ctx, "tcp", l.Addr().String(), nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected the dial to time out, got: %v", err)
+	}
+
+	// Cancelling works the same way
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = DialContext(ctx, "tcp", l.Addr().String(), nil)
+	if err != context.Canceled {
+		t.Fatalf("Expected the dial to be cancelled, got: %v", err)
+	}
+}
+
+func TestDialContextUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go Serve(l)
+
+	conn, err := DialContext(context.Background(), "unix", l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "hello world\n")
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "hello world\n" {
+		t.Fatalf("Unexpected result: %s != %s", got, "hello world\n")
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	srv := &Server{Config: &Config{HandshakeTimeout: 50 * time.Millisecond}}
+	go srv.Serve(l)
+
+	// Connect, and never say anything
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The server hangs up on us after its hello
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	if stats := srv.Stats(); stats.Accepted != 1 || stats.HandshakeTimeouts != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	srv := &Server{Config: &Config{IdleTimeout: 200 * time.Millisecond}}
+	go srv.Serve(l)
+
+	conn, err := DialWithConfig(l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Active clients are left alone
+	for i := 0; i < 3; i++ {
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprintf(conn, "hello world\n")
+		if _, err := conn.Read(make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Idle ones are dropped
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1024)); err != io.EOF {
+		t.Fatalf("Expected the server to hang up, got: %v", err)
+	}
+	if stats := srv.Stats(); stats.IdleTimeouts != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	apub, apriv, _ := box.GenerateKey(rand.Reader)
+	bpub, bpriv, _ := box.GenerateKey(rand.Reader)
+
+	c1, c2 := net.Pipe()
+	a := NewEncryptedConnection(c1, apriv, bpub)
+	b := NewEncryptedConnection(c2, bpriv, apub)
+	defer a.Close()
+	defer b.Close()
+
+	// Each writer sends messages filled with its own byte, so any
+	// interleaving shows up as a mixed message or a broken frame
+	const writers, messages, size = 8, 50, 3000
+	for i := 0; i < writers; i++ {
+		go func(id byte) {
+			msg := bytes.Repeat([]byte{id}, size)
+			for j := 0; j < messages; j++ {
+				if _, err := a.Write(msg); err != nil {
+					return
+				}
+			}
+		}(byte(i))
+	}
+
+	counts := make(map[byte]int)
+	buf := make([]byte, size)
+	for i := 0; i < writers*messages; i++ {
+		if _, err := io.ReadFull(b, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, bytes.Repeat(buf[:1], size)) {
+			t.Fatalf("Message %d was interleaved with another", i)
+		}
+		counts[buf[0]]++
+	}
+	for i := 0; i < writers; i++ {
+		if counts[byte(i)] != messages {
+			t.Fatalf("Unexpected message counts: %v", counts)
+		}
+	}
+}
+
+func TestBufferedWriter(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	var buf bytes.Buffer
+	secureW := NewBufferedSecureWriter(&buf, priv, pub, 100, 0)
+
+	// Small writes are held back until there is a frame's worth
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(secureW, "%04d", i)
+	}
+	if frames := splitFrames(buf.Bytes()); len(frames) != 1 {
+		t.Fatalf("Expected 1 full frame, got %d", len(frames))
+	}
+	if err := secureW.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if frames := splitFrames(buf.Bytes()); len(frames) != 2 {
+		t.Fatalf("Expected 2 frames after flushing, got %d", len(frames))
+	}
+
+	// Flushing again has nothing to send
+	secureW.Flush()
+	if frames := splitFrames(buf.Bytes()); len(frames) != 2 {
+		t.Fatalf("Expected nothing more after flushing twice, got %d frames", len(frames))
+	}
+
+	secureR := NewSecureReader(&buf, priv, pub)
+	got, err := ioutil.ReadAll(secureR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		if want := fmt.Sprintf("%04d", i); string(got[i*4:i*4+4]) != want {
+			t.Fatalf("Unexpected data at %d: %q", i, got[i*4:i*4+4])
+		}
+	}
+}
+
+func TestBufferedConnFlushDelay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go ServeWithConfig(l, &Config{WriteBufferSize: 1024})
+
+	conn, err := DialWithConfig(l.Addr().String(), &Config{WriteBufferSize: 1024, FlushDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Never flushed by us, so it goes out once the delay is up
+	fmt.Fprintf(conn, "hello ")
+	fmt.Fprintf(conn, "world\n")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := io.ReadAtLeast(conn, buf, len("hello world\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "hello world\n" {
+		t.Fatalf("Unexpected result:\nGot:\t\t%q\nExpected:\t%q", got, "hello world\n")
+	}
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+	message := bytes.Repeat([]byte("0123456789"), 35)
+
+	// ReadFrom fills whole frames
+	var buf bytes.Buffer
+	secureW := NewSecureWriterSize(&buf, priv, pub, 100)
+	n, err := io.Copy(secureW, bytes.NewReader(message))
+	if err != nil || n != int64(len(message)) {
+		t.Fatalf("Unexpected copy result: %d, %v", n, err)
+	}
+	if frames := splitFrames(buf.Bytes()); len(frames) != 4 {
+		t.Fatalf("Expected 4 frames, got %d", len(frames))
+	}
+
+	// WriteTo hands over each frame, including what's left of one
+	// that was partly read already
+	secureR := NewSecureReaderSize(&buf, priv, pub, 100)
+	head := make([]byte, 30)
+	if _, err := io.ReadFull(secureR, head); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	n, err = io.Copy(&out, secureR)
+	if err != nil || n != int64(len(message)-len(head)) {
+		t.Fatalf("Unexpected copy result: %d, %v", n, err)
+	}
+	if got := append(head, out.Bytes()...); !bytes.Equal(got, message) {
+		t.Fatalf("Unexpected result:\nGot:\t\t%q\nExpected:\t%q", got, message)
+	}
+}
+
+func benchmarkEcho(b *testing.B, handler Handler, size int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	go ServeWithConfig(l, &Config{Handler: handler})
+
+	conn, err := DialWithConfig(l.Addr().String(), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	message := make([]byte, size)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			conn.Write(message)
+		}
+	}()
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	if _, err := io.CopyN(ioutil.Discard, conn, int64(size)*int64(b.N)); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// bufferedEcho echoes the way io.Copy did before the connection
+// implemented io.WriterTo, through a 32 KiB buffer.
+var bufferedEcho = HandlerFunc(func(conn *EncryptedConnection, peerKey *[32]byte) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			conn.Write(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+})
+
+func BenchmarkEchoBuffered1K(b *testing.B) {
+	benchmarkEcho(b, bufferedEcho, 1024)
+}
+
+func BenchmarkEchoWriteTo1K(b *testing.B) {
+	benchmarkEcho(b, EchoHandler, 1024)
+}
+
+func BenchmarkEchoBuffered64K(b *testing.B) {
+	benchmarkEcho(b, bufferedEcho, 64*1024)
+}
+
+func BenchmarkEchoWriteTo64K(b *testing.B) {
+	benchmarkEcho(b, EchoHandler, 64*1024)
+}
+
+func TestMessages(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	var buf bytes.Buffer
+	secureW := NewBufferedSecureWriter(&buf, priv, pub, 1024, 0)
+	secureR := newSecureReader(&buf, priv, pub, DefaultMaxFrameSize, directionNone)
+
+	// Buffered stream writes go out ahead of the message
+	fmt.Fprintf(secureW, "hello ")
+	fmt.Fprintf(secureW, "world")
+	for _, message := range []string{"first", "", "third"} {
+		if err := secureW.WriteMessage([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{"hello world", "first", "", "third"}
+	for _, want := range expected {
+		got, err := secureR.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("Unexpected message:\nGot:\t\t%q\nExpected:\t%q", got, want)
+		}
+	}
+	if _, err := secureR.ReadMessage(); err != io.EOF {
+		t.Fatalf("Expected EOF, got: %v", err)
+	}
+
+	// A partly read frame is finished off by ReadMessage
+	secureW.WriteMessage([]byte("hello world"))
+	head := make([]byte, 6)
+	if _, err := io.ReadFull(secureR, head); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := secureR.ReadMessage(); err != nil || string(got) != "world" {
+		t.Fatalf("Unexpected rest of message: %q, %v", got, err)
+	}
+
+	// Messages must fit in a frame
+	large := make([]byte, DefaultMaxFrameSize+1)
+	if err := secureW.WriteMessage(large); err != ErrMessageTooLarge {
+		t.Fatalf("Expected ErrMessageTooLarge, got: %v", err)
+	}
+}
+
+func TestConnMessages(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go ServeWithConfig(l, nil)
+
+	conn, err := DialWithConfig(l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The echo server sends each frame back as it arrives
+	for _, message := range []string{"hello", "world", ""} {
+		if err := conn.WriteMessage([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != message {
+			t.Fatalf("Unexpected message:\nGot:\t\t%q\nExpected:\t%q", got, message)
+		}
+	}
+}
+
+func TestErrorClasses(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	var buf bytes.Buffer
+	secureW := NewSecureWriter(&buf, priv, pub)
+	fmt.Fprintf(secureW, "hello world\n")
+	fmt.Fprintf(secureW, "hello world\n")
+	frames := splitFrames(buf.Bytes())
+
+	read := func(stream []byte) error {
+		_, err := NewSecureReader(bytes.NewReader(stream), priv, pub).Read(make([]byte, 1024))
+		return err
+	}
+
+	tampered := append([]byte{}, frames[0]...)
+	tampered[len(tampered)-1] ^= 1
+	if err := read(tampered); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("Expected ErrAuthFailed, got: %v", err)
+	}
+	if err := read(frames[0][:len(frames[0])-1]); !errors.Is(err, ErrTruncatedFrame) {
+		t.Fatalf("Expected ErrTruncatedFrame, got: %v", err)
+	}
+	if err := read(frames[0][:2]); !errors.Is(err, ErrTruncatedFrame) {
+		t.Fatalf("Expected ErrTruncatedFrame, got: %v", err)
+	}
+	err := read(frames[1])
+	var serr *SequenceError
+	if !errors.Is(err, ErrReplayed) || !errors.As(err, &serr) {
+		t.Fatalf("Expected a SequenceError, got: %v", err)
+	}
+
+	// Handshake and host key errors belong to their class
+	for _, err := range []error{ErrBadMagic, ErrBadHello, ErrFrameSizeTooSmall, ErrHandshakeProof, &VersionError{3, 4}} {
+		if !errors.Is(err, ErrHandshake) {
+			t.Fatalf("Expected %v to be a handshake error", err)
+		}
+	}
+	for _, err := range []error{&UnknownHostError{}, &HostKeyMismatchError{}} {
+		if !errors.Is(err, ErrHostKey) {
+			t.Fatalf("Expected %v to be a host key error", err)
+		}
+	}
+}
+
+func TestConfigLogger(t *testing.T) {
+	var logs syncBuffer
+	config := &Config{Logger: slog.New(slog.NewTextHandler(&logs, nil))}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	srv := &Server{Config: config}
+	go srv.Serve(l)
+
+	// Garbage fails the handshake, which is logged rather than returned
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(bytes.Repeat([]byte{0xab}, 64))
+	io.Copy(ioutil.Discard, conn)
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "handshake failed") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the failure to be logged, got: %q", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that can be written and read concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestStructuredLogging(t *testing.T) {
+	var serverLogs, clientLogs syncBuffer
+	spub, spriv, _ := box.GenerateKey(rand.Reader)
+	cpub, cpriv, _ := box.GenerateKey(rand.Reader)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go ServeWithConfig(l, &Config{
+		PublicKey:  spub,
+		PrivateKey: spriv,
+		Logger:     slog.New(slog.NewJSONHandler(&serverLogs, nil)),
+	})
+
+	conn, err := DialWithConfig(l.Addr().String(), &Config{
+		PublicKey:  cpub,
+		PrivateKey: cpriv,
+		Logger:     slog.New(slog.NewJSONHandler(&clientLogs, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "hello world\n")
+	if _, err := io.ReadFull(conn, make([]byte, 12)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// Wait for the server to see the client go
+	events := func(logs *syncBuffer) map[string]map[string]interface{} {
+		byMsg := make(map[string]map[string]interface{})
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var event map[string]interface{}
+			if json.Unmarshal([]byte(line), &event) == nil {
+				byMsg[event["msg"].(string)] = event
+			}
+		}
+		return byMsg
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for events(&serverLogs)["connection closed"] == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the server to log the disconnect, got: %q", serverLogs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server, client := events(&serverLogs), events(&clientLogs)
+	tests := []struct {
+		event map[string]interface{}
+		key   string
+		want  interface{}
+	}{
+		{server["client connected"], "session", conn.SessionID()},
+		{server["client connected"], "fingerprint", Fingerprint(cpub)},
+		{server["connection closed"], "session", conn.SessionID()},
+		{server["connection closed"], "bytes_read", float64(12)},
+		{server["connection closed"], "bytes_written", float64(12)},
+		{client["connected to server"], "fingerprint", Fingerprint(spub)},
+		{client["connected to server"], "remote", l.Addr().String()},
+		{client["connection closed"], "bytes_written", float64(12)},
+	}
+	for _, test := range tests {
+		if test.event == nil || test.event[test.key] != test.want {
+			t.Fatalf("Expected %s=%v in %v", test.key, test.want, test.event)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go ServeWithConfig(l, &Config{Metrics: metrics})
+
+	// One client that echoes, and one that fails the handshake
+	conn, err := DialWithConfig(l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "hello world\n")
+	if _, err := io.ReadFull(conn, make([]byte, 12)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	garbage, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage.Write(bytes.Repeat([]byte{0xab}, 64))
+	io.Copy(ioutil.Discard, garbage)
+	garbage.Close()
+
+	expected := []string{
+		"secure_echo_connections_accepted_total 2\n",
+		"secure_echo_handshake_failures_total 1\n",
+		"secure_echo_read_bytes_total 12\n",
+		"secure_echo_written_bytes_total 12\n",
+		"secure_echo_connections_active 0\n",
+		"secure_echo_handshake_duration_seconds_count 1\n",
+		"secure_echo_frame_read_bytes_bucket{le=\"64\"} 1\n",
+		"secure_echo_frame_written_bytes_bucket{le=\"+Inf\"} 1\n",
+		"secure_echo_frame_written_bytes_sum 12\n",
+	}
+
+	// The server may take a moment to notice the client has gone
+	var body string
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec := httptest.NewRecorder()
+		metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body = rec.Body.String()
+
+		missing := ""
+		for _, line := range expected {
+			if !strings.Contains(body, line) {
+				missing = line
+				break
+			}
+		}
+		if missing == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %q in metrics:\n%s", missing, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerHooks(t *testing.T) {
+	apub, apriv, _ := box.GenerateKey(rand.Reader)
+	vpub, vpriv, _ := box.GenerateKey(rand.Reader)
+	upub, upriv, _ := box.GenerateKey(rand.Reader)
+
+	type sessionKey struct{}
+	authFailures := make(chan error, 1)
+	closed := make(chan ConnStats, 1)
+	var accepted atomic.Int64
+	hooks := Hooks{
+		OnAccept: func(remote net.Addr) error {
+			if accepted.Add(1) > 3 {
+				return errors.New("too many connections")
+			}
+			return nil
+		},
+		OnHandshake: func(ctx context.Context, conn *EncryptedConnection) (context.Context, error) {
+			if *conn.PeerPublicKey() == *vpub {
+				return nil, errors.New("banned")
+			}
+			return context.WithValue(ctx, sessionKey{}, "session for "+Fingerprint(conn.PeerPublicKey())), nil
+		},
+		OnAuthFailure: func(remote net.Addr, err error) {
+			authFailures <- err
+		},
+		OnClose: func(conn *EncryptedConnection, stats ConnStats) {
+			closed <- stats
+		},
+	}
+
+	// The handler sends back the state attached by OnHandshake
+	handler := HandlerFunc(func(conn *EncryptedConnection, peerKey *[32]byte) {
+		io.ReadFull(conn, make([]byte, 5))
+		conn.WriteMessage([]byte(conn.Context().Value(sessionKey{}).(string)))
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go ServeWithConfig(l, &Config{
+		AuthorizedKeys: NewAuthorizedKeys(apub, vpub),
+		Handler:        handler,
+		Hooks:          hooks,
+	})
+
+	// An allowed client gets its session state, and is seen out by OnClose
+	conn, err := DialWithConfig(l.Addr().String(), &Config{PublicKey: apub, PrivateKey: apriv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "hello")
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "session for " + Fingerprint(apub); string(msg) != want {
+		t.Fatalf("Unexpected session state: %q", msg)
+	}
+	conn.Close()
+	select {
+	case stats := <-closed:
+		if stats.BytesReceived != 5 || stats.BytesSent != int64(len(msg)) {
+			t.Fatalf("Unexpected stats: %+v", stats)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose was not called")
+	}
+
+	// OnHandshake can refuse a client that is authorized
+	conn, err = DialWithConfig(l.Addr().String(), &Config{PublicKey: vpub, PrivateKey: vpriv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Read(make([]byte, 1))
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Reason != "banned" {
+		t.Fatalf("Expected to be banned, got: %v", err)
+	}
+	conn.Close()
+
+	// A client that isn't authorized is refused, and reported
+	_, err = DialWithConfig(l.Addr().String(), &Config{PublicKey: upub, PrivateKey: upriv})
+	if _, ok := err.(*RemoteError); !ok {
+		t.Fatalf("Expected the dial to be refused, got: %v", err)
+	}
+	select {
+	case err := <-authFailures:
+		if err != ErrUnauthorized {
+			t.Fatalf("Expected ErrUnauthorized, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnAuthFailure was not called")
+	}
+
+	// OnAccept turns away the fourth connection before the handshake
+	_, err = DialWithConfig(l.Addr().String(), nil)
+	if err == nil {
+		t.Fatal("Expected the connection to be refused")
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	apub, apriv, _ := box.GenerateKey(rand.Reader)
+	bpub, bpriv, _ := box.GenerateKey(rand.Reader)
+
+	c1, c2 := net.Pipe()
+	a := NewEncryptedConnection(c1, apriv, bpub)
+	b := NewEncryptedConnection(c2, bpriv, apub)
+	defer a.Close()
+	defer b.Close()
+
+	// Two good frames and a forged one
+	go func() {
+		a.WriteMessage([]byte("hello"))
+		a.WriteMessage([]byte("world!"))
+		forged := make([]byte, 4+frameOverhead+3)
+		binary.LittleEndian.PutUint32(forged, uint32(frameOverhead+3))
+		c1.Write(forged)
+	}()
+	for i := 0; i < 2; i++ {
+		if _, err := b.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.ReadMessage(); err != ErrAuthFailed {
+		t.Fatalf("Expected ErrAuthFailed, got: %v", err)
+	}
+
+	sent, received := a.Stats(), b.Stats()
+	if sent.BytesSent != 11 || sent.FramesSent != 2 || sent.WireBytesSent != 11+2*(4+frameOverhead) {
+		t.Fatalf("Unexpected sender stats: %+v", sent)
+	}
+	if received.BytesReceived != 11 || received.FramesReceived != 2 || received.DecryptFailures != 1 ||
+		received.WireBytesReceived != 14+3*(4+frameOverhead) {
+		t.Fatalf("Unexpected receiver stats: %+v", received)
+	}
+	if received.Age <= 0 {
+		t.Fatalf("Unexpected connection age: %v", received.Age)
+	}
+
+	// Connections that went through a handshake know how long it took
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go Serve(l)
+
+	conn, err := DialWithConfig(l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if stats := conn.Stats(); stats.HandshakeDuration <= 0 {
+		t.Fatalf("Unexpected handshake duration: %v", stats.HandshakeDuration)
+	}
+}
+
+func TestCloseFrames(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	// A sealed reason ends the stream with a RemoteError
+	var buf bytes.Buffer
+	secureW := newSecureWriter(&buf, priv, pub, DefaultMaxFrameSize, directionNone)
+	fmt.Fprintf(secureW, "hello world\n")
+	secureW.writeClose("going away")
+	secureR := NewSecureReader(&buf, priv, pub)
+	if _, err := secureR.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := secureR.Read(make([]byte, 1024))
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Reason != "going away" {
+		t.Fatalf("Expected a remote error, got: %v", err)
+	}
+
+	// But one sent in the clear, as during the handshake, can't end a session
+	buf.Reset()
+	fmt.Fprintf(NewSecureWriter(&buf, priv, pub), "hello world\n")
+	writeErrorFrame(&buf, ErrUnauthorized.Error())
+	secureR = NewSecureReader(&buf, priv, pub)
+	if _, err := secureR.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = secureR.Read(make([]byte, 1024))
+	if _, ok := err.(*RemoteError); ok || err == nil {
+		t.Fatalf("Expected a forged error frame to be refused, got: %v", err)
+	}
+}
+
+func TestMaxFrameSizeNegotiation(t *testing.T) {
+	// The server allows large frames, and sends a big reply
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	reply := bytes.Repeat([]byte{'x'}, 200000)
+	go ServeWithConfig(l, &Config{
+		MaxFrameSize: 1 << 20,
+		Handler: HandlerFunc(func(conn *EncryptedConnection, peerKey *[32]byte) {
+			io.ReadFull(conn, make([]byte, 5))
+			conn.Write(reply)
+		}),
+	})
+
+	// A client with the default limit still gets it, in smaller frames
+	conn, err := DialWithConfig(l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "hello")
+	got := make([]byte, len(reply))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, reply) {
+		t.Fatal("Unexpected reply")
+	}
+	if stats := conn.Stats(); stats.FramesReceived != 4 {
+		t.Fatalf("Expected 4 frames of at most %d bytes, got: %+v", DefaultMaxFrameSize, stats)
+	}
+}
+
+func TestNonPositiveFrameSize(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	var buf bytes.Buffer
+	n, err := NewSecureWriterSize(&buf, priv, pub, 0).Write([]byte("hello"))
+	if err != nil || n != 5 {
+		t.Fatalf("Unexpected write result: %d, %v", n, err)
+	}
+	if frames := splitFrames(buf.Bytes()); len(frames) != 1 {
+		t.Fatalf("Expected 1 frame, got %d", len(frames))
+	}
+	got, err := ioutil.ReadAll(NewSecureReaderSize(&buf, priv, pub, -1))
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("Unexpected read result: %q, %v", got, err)
+	}
+}
+
+func TestEncryptedConnectionReflection(t *testing.T) {
+	apub, apriv, _ := box.GenerateKey(rand.Reader)
+	bpub, bpriv, _ := box.GenerateKey(rand.Reader)
+
+	c1, c2 := net.Pipe()
+	a := NewEncryptedConnection(c1, apriv, bpub)
+	defer a.Close()
+	defer c2.Close()
+
+	// Bounce A's frame straight back, then have B speak for itself
+	go func() {
+		a.Write([]byte("from A"))
+	}()
+	go func() {
+		var header [4]byte
+		io.ReadFull(c2, header[:])
+		payload := make([]byte, binary.LittleEndian.Uint32(header[:]))
+		io.ReadFull(c2, payload)
+		c2.Write(header[:])
+		c2.Write(payload)
+		NewEncryptedConnection(c2, bpriv, apub).Write([]byte("from B"))
+	}()
+
+	buf := make([]byte, 1024)
+	if _, err := a.Read(buf); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("Expected a reflected frame to be refused, got: %v", err)
+	}
+	n, err := a.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "from B" {
+		t.Fatalf("Unexpected message: %q", got)
+	}
+}
+
+func TestListenerAcceptTimeout(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(inner, &Config{HandshakeTimeout: 100 * time.Millisecond})
+	defer l.Close()
+
+	// Nobody calls Accept, so the finished connection is dropped
+	// once the handshake deadline passes
+	conn, err := DialWithConfig(inner.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the server to hang up, got: %v", err)
+	}
+}
+
+func TestServerCloseFromOnClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// A hook that calls back into the server while it is closing, and a
+	// handler that leaves the connection for Close to shut
+	srv := &Server{}
+	served := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	hooked := make(chan struct{})
+	srv.Config = &Config{
+		Handler: HandlerFunc(func(conn *EncryptedConnection, peerKey *[32]byte) {
+			close(served)
+			<-release
+		}),
+		Hooks: Hooks{
+			OnClose: func(conn *EncryptedConnection, stats ConnStats) {
+				srv.Close()
+				close(hooked)
+			},
+		},
+	}
+	go srv.Serve(l)
+
+	conn, err := DialWithConfig(l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-served
+
+	closed := make(chan struct{})
+	go func() {
+		srv.Close()
+		close(closed)
+	}()
+	for _, c := range []chan struct{}{hooked, closed} {
+		select {
+		case <-c:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close deadlocked")
+		}
+	}
+}
+
+func TestCloseFlushesBuffered(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	ec := NewEncryptedConnection(c1, priv, pub)
+	ec.sw.setBuffering(1024, time.Hour)
+	if _, err := ec.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- ec.Close() }()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(NewSecureReader(c2, priv, pub), buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != "hello" {
+		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\thello", got)
+	}
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is left for the flush timer to send
+	ec.sw.mu.Lock()
+	timer := ec.sw.timer
+	ec.sw.mu.Unlock()
+	if timer != nil {
+		t.Fatal("flush timer still running after Close")
+	}
+	if _, err := ec.Write([]byte("again")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Write after Close: got %v, expected %v", err, net.ErrClosed)
+	}
+}
+
+func TestServerCloseStuckWriters(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Handlers that write until the connection is closed under them
+	srv := &Server{Config: &Config{
+		Handler: HandlerFunc(func(conn *EncryptedConnection, peerKey *[32]byte) {
+			buf := make([]byte, 64*1024)
+			for {
+				if _, err := conn.Write(buf); err != nil {
+					return
+				}
+			}
+		}),
+	}}
+	go srv.Serve(l)
+
+	// Clients that never read, so the handlers get stuck
+	for i := 0; i < 4; i++ {
+		conn, err := DialWithConfig(l.Addr().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	srv.Close()
+	if elapsed := time.Since(start); elapsed > closeFlushTimeout/2 {
+		t.Fatalf("Close took %v", elapsed)
+	}
+}
+
+func TestHelloFrameSizeTooSmall(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	// A client that asks for one byte frames is refused
+	remote := make(chan error, 1)
+	go func() {
+		if _, err := readHandshakeMessage(c, msgServerHello); err != nil {
+			remote <- err
+			return
+		}
+		h, _, _ := newHello(DefaultMaxFrameSize)
+		h.maxFrameSize = 1
+		writeHandshakeMessage(c, msgClientHello, h.marshal())
+		_, err := readHandshakeMessage(c, msgServerProof)
+		remote <- err
+	}()
+
+	_, _, err := serverHandshake(s, nil)
+	if err != ErrFrameSizeTooSmall {
+		t.Fatalf("Expected ErrFrameSizeTooSmall, got: %v", err)
+	}
+	var rerr *RemoteError
+	if err := <-remote; !errors.As(err, &rerr) || rerr.Reason != ErrFrameSizeTooSmall.Error() {
+		t.Fatalf("Expected the client to be told why, got: %v", err)
+	}
+
+	// A short hello is malformed, rather than another protocol
+	h, _, _ := newHello(DefaultMaxFrameSize)
+	if _, err := unmarshalHello(h.marshal()[:helloSize-1]); err != ErrBadHello {
+		t.Fatalf("Expected ErrBadHello, got: %v", err)
+	}
+
+	// Our own limit is never advertised below the minimum
+	if got := (&Config{MaxFrameSize: 1}).maxFrameSize(); got != MinFrameSize {
+		t.Fatalf("Expected %d, got %d", MinFrameSize, got)
+	}
+}
+
+// flakyListener fails its first few Accepts with a temporary error.
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestListenerTemporaryError(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(&flakyListener{Listener: inner, failures: 3}, nil)
+	defer l.Close()
+
+	go func() {
+		conn, err := DialWithConfig(l.Addr().String(), nil)
+		if err == nil {
+			defer conn.Close()
+			fmt.Fprintf(conn, "hello")
+		}
+	}()
+
+	// The listener rides out the errors, rather than giving up
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	// But not once it is closed
+	l.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("Expected Accept to fail once closed")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics collects counters and histograms about a server's
+// connections, see Config.Metrics. It serves them over HTTP in the
+// Prometheus text format, and is safe for concurrent use.
+type Metrics struct {
+	accepted          atomic.Int64
+	active            atomic.Int64
+	handshakeFailures atomic.Int64
+	handshakeTimeouts atomic.Int64
+	unauthorized      atomic.Int64
+	decryptFailures   atomic.Int64
+	bytesRead         atomic.Int64
+	bytesWritten      atomic.Int64
+
+	handshakeSeconds  *histogram
+	frameReadBytes    *histogram
+	frameWrittenBytes *histogram
+}
+
+// NewMetrics returns an empty set of metrics.
+func NewMetrics() *Metrics {
+	frameBuckets := []float64{64, 256, 1024, 4096, 16384, 65536}
+	return &Metrics{
+		handshakeSeconds:  newHistogram([]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}),
+		frameReadBytes:    newHistogram(frameBuckets),
+		frameWrittenBytes: newHistogram(frameBuckets),
+	}
+}
+
+func (m *Metrics) observeHandshake(d time.Duration) {
+	m.handshakeSeconds.observe(d.Seconds())
+}
+
+// frameRead and frameWritten are called with the data carried
+// by each frame, see SecureReader.observe.
+func (m *Metrics) frameRead(n int) {
+	m.bytesRead.Add(int64(n))
+	m.frameReadBytes.observe(float64(n))
+}
+
+func (m *Metrics) frameWritten(n int) {
+	m.bytesWritten.Add(int64(n))
+	m.frameWrittenBytes.observe(float64(n))
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	counters := []struct {
+		name, help string
+		value      *atomic.Int64
+	}{
+		{"secure_echo_connections_accepted_total", "Connections accepted, before the handshake.", &m.accepted},
+		{"secure_echo_handshake_failures_total", "Handshakes that failed.", &m.handshakeFailures},
+		{"secure_echo_handshake_timeouts_total", "Handshakes that timed out.", &m.handshakeTimeouts},
+		{"secure_echo_unauthorized_clients_total", "Clients refused for a key that isn't authorized.", &m.unauthorized},
+		{"secure_echo_decrypt_failures_total", "Frames that failed authentication.", &m.decryptFailures},
+		{"secure_echo_read_bytes_total", "Data received from clients.", &m.bytesRead},
+		{"secure_echo_written_bytes_total", "Data sent to clients.", &m.bytesWritten},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value.Load())
+	}
+	fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n",
+		"secure_echo_connections_active", "Connections past the handshake and not yet closed.",
+		"secure_echo_connections_active", "secure_echo_connections_active", m.active.Load())
+
+	m.handshakeSeconds.write(&buf, "secure_echo_handshake_duration_seconds", "Time taken by successful handshakes.")
+	m.frameReadBytes.write(&buf, "secure_echo_frame_read_bytes", "Data carried by each frame received.")
+	m.frameWrittenBytes.write(&buf, "secure_echo_frame_written_bytes", "Data carried by each frame sent.")
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP serves the metrics, for scraping by Prometheus.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// histogram counts observations into buckets with the given upper bounds.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // one per bound, and one for +Inf
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var total uint64
+	for i, count := range h.counts {
+		total += count
+		bound := math.Inf(1)
+		if i < len(h.bounds) {
+			bound = h.bounds[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatBound(bound), total)
+	}
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, total)
+}
+
+func formatBound(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Nonces are built from a sequence number rather than picked at random,
+// so that readers can detect replayed, dropped and reordered frames:
+//   nonce = | 1-byte direction | 15-byte random stream prefix | 8-byte big-endian sequence number |
+//
+// Both ends of a connection share the same key, so the direction byte
+// keeps the two streams from ever using the same nonce, and stops
+// frames being reflected back to their sender.
+const (
+	directionNone           = 0 // standalone reader/writer pairs
+	directionClientToServer = 1
+	directionServerToClient = 2
+
+	// Set in the direction byte of a frame that carries the reason the
+	// peer is closing the connection, rather than data. Being part of the
+	// nonce, it is authenticated along with the frame.
+	frameClose = 0x80
+)
+
+// SequenceError is returned when a frame is not the next one expected
+// on the stream, because it was replayed, reordered or dropped.
+type SequenceError struct {
+	Expected, Got uint64
+}
+
+func (e *SequenceError) Error() string {
+	return fmt.Sprintf("frame out of sequence: expected %d, got %d", e.Expected, e.Got)
+}
+
+func (e *SequenceError) Is(target error) bool {
+	return target == ErrReplayed
+}
+
+func nonceSequence(nonce *[24]byte) uint64 {
+	return binary.BigEndian.Uint64(nonce[16:])
+}
+
+func setNonceSequence(nonce *[24]byte, seq uint64) {
+	binary.BigEndian.PutUint64(nonce[16:], seq)
+}
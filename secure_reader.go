@@ -1,38 +1,87 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"golang.org/x/crypto/nacl/box"
 	"io"
-	"log"
+	"sync/atomic"
 )
 
-type ReadError struct {
-	Message string
+// A size that marks an error frame sent by the peer in place of
+// a handshake message, see writeErrorFrame.
+const (
+	errorFrameMarker   = 0xFFFFFFFF
+	maxErrorReasonSize = 1024
+)
+
+// RemoteError is returned when the peer closed the connection and
+// said why, such as a server rejecting our key.
+type RemoteError struct {
+	Reason string
 }
 
-func (e *ReadError) Error() string {
-	return e.Message
+func (e *RemoteError) Error() string {
+	return "connection closed by peer: " + e.Reason
 }
 
 type SecureReader struct {
-	r        io.Reader
-	priv     *[32]byte
-	pub      *[32]byte
-	leftover []byte
+	r            io.Reader
+	sharedKey    *[32]byte
+	maxFrameSize int
+	direction    byte
+	prefix       []byte
+	seq          uint64
+	leftover     []byte
+	payload      []byte
+	plaintext    []byte
+
+	// Progress through the current frame, so that a read that fails
+	// part way through one (say, on a deadline) can pick up from there
+	header   [4]byte
+	headerN  int
+	payloadN int
+
+	// The writer for the other half of the connection, if any, whose
+	// frames must never be accepted here
+	own *SecureWriter
+
+	// Counts for ConnStats, which may be read from other goroutines
+	bytesRead       atomic.Int64
+	wireBytesRead   atomic.Int64
+	framesRead      atomic.Int64
+	decryptFailures atomic.Int64
+
+	// If set, called with the data carried by each frame received
+	observe func(n int)
 }
 
 func NewSecureReader(r io.Reader, priv, pub *[32]byte) io.Reader {
-	return &SecureReader{r, priv, pub, nil}
+	return newSecureReader(r, priv, pub, DefaultMaxFrameSize, directionNone)
+}
+
+// NewSecureReaderSize is like NewSecureReader, but refuses frames
+// carrying more than maxFrameSize bytes of data. A size that isn't
+// positive means DefaultMaxFrameSize.
+func NewSecureReaderSize(r io.Reader, priv, pub *[32]byte, maxFrameSize int) io.Reader {
+	return newSecureReader(r, priv, pub, maxFrameSize, directionNone)
+}
+
+func newSecureReader(r io.Reader, priv, pub *[32]byte, maxFrameSize int, direction byte) *SecureReader {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+
+	// Do the expensive key agreement once, rather than for every message
+	sharedKey := new([32]byte)
+	box.Precompute(sharedKey, pub, priv)
+	return &SecureReader{r: r, sharedKey: sharedKey, maxFrameSize: maxFrameSize, direction: direction}
 }
 
 func (sr *SecureReader) Read(out []byte) (int, error) {
-	// If there isn't a leftover buffer, then it's time to read the next encrypted message
-	if sr.leftover == nil {
-		err := sr.ReadNextEncryptedMessage()
-		if err != nil {
-			return 0, err
-		}
+	err := sr.fill()
+	if err != nil {
+		return 0, err
 	}
 
 	// Send as much data as possible
@@ -50,28 +99,104 @@ func (sr *SecureReader) Read(out []byte) (int, error) {
 	return len(toSend), nil
 }
 
+// ReadMessage returns the data from the next frame, as sent by a single
+// WriteMessage. If the current frame has been partly read through Read,
+// it returns the rest of that one instead.
+func (sr *SecureReader) ReadMessage() ([]byte, error) {
+	err := sr.fill()
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy the message out, as the buffer is reused for the next frame
+	message := append([]byte{}, sr.leftover...)
+	sr.leftover = nil
+	return message, nil
+}
+
+// WriteTo writes each frame to w as soon as it is decrypted, until EOF,
+// rather than copying it through a buffer of the caller's.
+func (sr *SecureReader) WriteTo(w io.Writer) (int64, error) {
+	return sr.writeTo(w, sr.fill)
+}
+
+// writeTo is WriteTo, with fill used to get each frame.
+func (sr *SecureReader) writeTo(w io.Writer, fill func() error) (int64, error) {
+	var total int64
+	for {
+		err := fill()
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+
+		n, err := w.Write(sr.leftover)
+		total += int64(n)
+		if err == nil && n < len(sr.leftover) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			sr.leftover = sr.leftover[n:]
+			return total, err
+		}
+		sr.leftover = nil
+	}
+}
+
+// fill reads the next encrypted message, unless there is
+// still some of the last one left over.
+func (sr *SecureReader) fill() error {
+	if sr.leftover != nil {
+		return nil
+	}
+	return sr.ReadNextEncryptedMessage()
+}
+
 // Blocking read until the whole encrypted message is received
 // Encrypted messages are in the format:
 //   message = | 4-byte little-endian uint32 for payload size | payload |
 //   payload = | 24-byte nonce | encrypted message |
+// See nonce.go for the layout of the nonce.
+//
+// If the underlying reader fails part way through a message, the
+// next call resumes reading it where this one left off.
 func (sr *SecureReader) ReadNextEncryptedMessage() error {
 	// Read the payload size out of the buffer
-	var payloadSize uint32
-	err := binary.Read(sr.r, binary.LittleEndian, &payloadSize)
-	if err != nil {
-		if err != io.EOF {
-			log.Println("Error reading payloadSize from buffer", err)
+	if sr.headerN < len(sr.header) {
+		err := readFull(sr.r, sr.header[:], &sr.headerN)
+		if err == io.ErrUnexpectedEOF {
+			return ErrTruncatedFrame
 		}
-		return err
+		if err != nil {
+			return err
+		}
+		sr.payloadN = 0
+	}
+	payloadSize := binary.LittleEndian.Uint32(sr.header[:])
+
+	// Don't trust the size until we have checked it, as it isn't authenticated
+	if int64(payloadSize) > int64(sr.maxFrameSize)+frameOverhead {
+		sr.headerN = 0
+		return ErrFrameTooLarge
+	}
+	if payloadSize < frameOverhead {
+		sr.headerN = 0
+		return ErrTruncatedFrame
 	}
 
-	// Read the payload
-	data := make([]byte, payloadSize)
-	_, err = io.ReadFull(sr.r, data)
+	// Read the payload, reusing the same buffer for every frame
+	if cap(sr.payload) < int(payloadSize) {
+		sr.payload = make([]byte, payloadSize)
+	}
+	data := sr.payload[:payloadSize]
+	err := readFull(sr.r, data, &sr.payloadN)
 	if err != nil {
-		log.Println("Error reading payload from buffer", err)
-		return err
+		return noEOF(err)
 	}
+	sr.headerN = 0
+	sr.wireBytesRead.Add(int64(len(sr.header) + len(data)))
 
 	// Unpack the nonce and encrypted message
 	nonce := data[0:24]
@@ -80,12 +205,79 @@ func (sr *SecureReader) ReadNextEncryptedMessage() error {
 	// Decrypt the encrypted message
 	var nonceBuf [24]byte
 	copy(nonceBuf[:], nonce)
-	decrypted, success := box.Open(make([]byte, 0), encrypted, &nonceBuf, sr.pub, sr.priv)
-	if success {
-		sr.leftover = decrypted
-		return nil
-	} else {
-		log.Println("Error decrypting message")
-		return &ReadError{"Error decrypting message"}
+	decrypted, success := box.OpenAfterPrecomputation(sr.plaintext[:0], encrypted, &nonceBuf, sr.sharedKey)
+	if !success {
+		sr.decryptFailures.Add(1)
+		return ErrAuthFailed
+	}
+
+	// Now that we know the nonce is genuine, make sure the frame is the next
+	// one in this stream. The first frame tells us the stream's prefix.
+	if nonceBuf[0]&^frameClose != sr.direction {
+		return ErrReplayed
+	}
+	if sr.prefix == nil && nonceSequence(&nonceBuf) == 0 {
+		// A stream that starts like ours is our own frames sent back to us
+		if sr.own != nil && sr.own.sentPrefix(nonceBuf[1:16]) {
+			return ErrReplayed
+		}
+		sr.prefix = append([]byte{}, nonceBuf[1:16]...)
+	}
+	if sr.prefix == nil || !bytes.Equal(sr.prefix, nonceBuf[1:16]) || nonceSequence(&nonceBuf) != sr.seq {
+		return &SequenceError{sr.seq, nonceSequence(&nonceBuf)}
+	}
+	sr.seq++
+
+	// The peer is hanging up on us
+	if nonceBuf[0]&frameClose != 0 {
+		return &RemoteError{string(decrypted)}
+	}
+	sr.bytesRead.Add(int64(len(decrypted)))
+	sr.framesRead.Add(1)
+	if sr.observe != nil {
+		sr.observe(len(decrypted))
+	}
+
+	// The leftover buffer is always used up before the next frame is read,
+	// so the plaintext buffer can be reused as well
+	sr.plaintext = decrypted
+	sr.leftover = decrypted
+	return nil
+}
+
+// Read the reason out of an error frame, once the marker has been read.
+func readErrorFrame(r io.Reader) error {
+	var reasonSize uint32
+	err := binary.Read(r, binary.LittleEndian, &reasonSize)
+	if err != nil {
+		return noEOF(err)
+	}
+	if reasonSize > maxErrorReasonSize {
+		return ErrFrameTooLarge
+	}
+	reason := make([]byte, reasonSize)
+	_, err = io.ReadFull(r, reason)
+	if err != nil {
+		return noEOF(err)
+	}
+	return &RemoteError{string(reason)}
+}
+
+// readFull is like io.ReadFull, but keeps count of the bytes read so far
+// in *n, so that it can be called again to finish after an error.
+func readFull(r io.Reader, buf []byte, n *int) error {
+	for *n < len(buf) {
+		nn, err := r.Read(buf[*n:])
+		*n += nn
+		if *n == len(buf) {
+			return nil
+		}
+		if err != nil {
+			if err == io.EOF && *n > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
 	}
+	return nil
 }
@@ -1,57 +1,360 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/binary"
 	"golang.org/x/crypto/nacl/box"
 	"io"
-	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// DefaultMaxFrameSize is the most data carried by a single frame,
+// unless configured otherwise.
+const DefaultMaxFrameSize = 64 * 1024
+
+// MinFrameSize is the smallest frame limit a peer may ask for in the
+// handshake. Tiny frames would make the other end spend a seal and
+// frameOverhead bytes on every few bytes of data.
+const MinFrameSize = 1024
+
+// closeFlushTimeout bounds how long close waits to send buffered data.
+const closeFlushTimeout = time.Second
+
+// frameOverhead is the size of a payload besides the data it carries.
+const frameOverhead = 24 + box.Overhead
+
+// SecureWriter is safe for concurrent use. Each Write is sent as
+// a whole, so frames from different goroutines never interleave.
+//
+// A buffered SecureWriter (see NewBufferedSecureWriter) instead gathers
+// small writes into one frame, which is sent once it is full, on Flush,
+// or after the flush delay.
 type SecureWriter struct {
-	w    io.Writer
-	priv *[32]byte
-	pub  *[32]byte
+	mu           sync.Mutex
+	w            io.Writer
+	sharedKey    *[32]byte
+	maxFrameSize int
+	direction    byte
+	nonce        atomic.Pointer[[24]byte] // see sentPrefix
+	seq          uint64
+	buf          []byte
+	err          error
+
+	// Counts for ConnStats, which may be read without holding mu
+	bytesWritten     atomic.Int64
+	wireBytesWritten atomic.Int64
+	framesWritten    atomic.Int64
+
+	// If set, called with the data carried by each frame sent
+	observe func(n int)
+
+	// Buffered mode only
+	bufSize    int
+	flushDelay time.Duration
+	pending    []byte
+	timer      *time.Timer
 }
 
 func NewSecureWriter(w io.Writer, priv, pub *[32]byte) io.Writer {
-	return &SecureWriter{w, priv, pub}
+	return newSecureWriter(w, priv, pub, DefaultMaxFrameSize, directionNone)
+}
+
+// NewSecureWriterSize is like NewSecureWriter, but splits writes into
+// frames carrying at most maxFrameSize bytes of data each. A size that
+// isn't positive means DefaultMaxFrameSize.
+func NewSecureWriterSize(w io.Writer, priv, pub *[32]byte, maxFrameSize int) io.Writer {
+	return newSecureWriter(w, priv, pub, maxFrameSize, directionNone)
 }
 
+// NewBufferedSecureWriter is like NewSecureWriter, but holds on to
+// written data until it has bufSize bytes to send in one frame, or
+// until Flush is called. If flushDelay is positive, data is flushed
+// by itself once it has been waiting that long.
+func NewBufferedSecureWriter(w io.Writer, priv, pub *[32]byte, bufSize int, flushDelay time.Duration) *SecureWriter {
+	sw := newSecureWriter(w, priv, pub, DefaultMaxFrameSize, directionNone)
+	sw.setBuffering(bufSize, flushDelay)
+	return sw
+}
+
+func newSecureWriter(w io.Writer, priv, pub *[32]byte, maxFrameSize int, direction byte) *SecureWriter {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+
+	// Do the expensive key agreement once, rather than for every message
+	sharedKey := new([32]byte)
+	box.Precompute(sharedKey, pub, priv)
+	return &SecureWriter{w: w, sharedKey: sharedKey, maxFrameSize: maxFrameSize, direction: direction}
+}
+
+// Write encrypts message into one or more frames. Large messages are
+// split up, so that memory use stays bounded on both ends and the reader
+// can start on the first frames before the rest have been sent. If an
+// error occurs, the count only includes frames that were fully written.
 func (sw *SecureWriter) Write(message []byte) (int, error) {
-	// Generate a random nonce
-	nonce, err := randomNonce()
-	if err != nil {
-		log.Println("Error generating nonce", err)
-		return 0, err
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if sw.bufSize > 0 {
+		return sw.writeBuffered(message)
+	}
+
+	// Split the message up, so that no frame is too large for the reader
+	written := 0
+	for {
+		chunk := message
+		if len(chunk) > sw.maxFrameSize {
+			chunk = chunk[:sw.maxFrameSize]
+		}
+		err := sw.writeFrame(chunk, 0)
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		message = message[len(chunk):]
+		if len(message) == 0 {
+			return written, nil
+		}
 	}
+}
 
-	// Convert message to encrypted byte slice with nonce
-	encrypted := box.Seal(nonce[:], message, nonce, sw.pub, sw.priv)
-	payloadSize := len(encrypted)
+// WriteMessage sends message as a frame of its own, which the peer's
+// ReadMessage returns whole. Anything buffered is sent first.
+func (sw *SecureWriter) WriteMessage(message []byte) error {
+	if len(message) > sw.maxFrameSize {
+		return ErrMessageTooLarge
+	}
 
-	// Write payload size to buffer
-	err = binary.Write(sw.w, binary.LittleEndian, uint32(payloadSize))
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	err := sw.flushLocked()
 	if err != nil {
-		log.Println("Error writing payloadSize to buffer", err)
-		return 0, err
+		return err
+	}
+	return sw.writeFrame(message, 0)
+}
+
+// ReadFrom encrypts everything read from r until EOF, reading up to a
+// whole frame at a time. Other writers may slip in between frames.
+func (sw *SecureWriter) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, sw.maxFrameSize)
+	var total int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			_, werr := sw.Write(buf[:n])
+			if werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// setBuffering turns on buffered mode, unless bufSize is zero.
+// A buffer can't be larger than a frame.
+func (sw *SecureWriter) setBuffering(bufSize int, flushDelay time.Duration) {
+	if bufSize > sw.maxFrameSize {
+		bufSize = sw.maxFrameSize
+	}
+	sw.bufSize = bufSize
+	sw.flushDelay = flushDelay
+}
+
+// writeBuffered adds message to the pending frame, sending it each
+// time it fills up. Like bufio.Writer, errors from sending earlier
+// data may only show up in a later call.
+func (sw *SecureWriter) writeBuffered(message []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	if sw.pending == nil {
+		sw.pending = make([]byte, 0, sw.bufSize)
 	}
 
-	// Write encrypted message to buffer
-	_, err = sw.w.Write(encrypted)
+	written := 0
+	for len(message) > 0 {
+		n := copy(sw.pending[len(sw.pending):sw.bufSize], message)
+		sw.pending = sw.pending[:len(sw.pending)+n]
+		written += n
+		message = message[n:]
+
+		if len(sw.pending) == sw.bufSize {
+			err := sw.flushLocked()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	// Don't let a few bytes wait forever for someone to call Flush
+	if len(sw.pending) > 0 && sw.flushDelay > 0 && sw.timer == nil {
+		sw.timer = time.AfterFunc(sw.flushDelay, func() { sw.Flush() })
+	}
+	return written, nil
+}
+
+// Flush sends any buffered data. It does nothing for a writer
+// that isn't buffered.
+func (sw *SecureWriter) Flush() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.flushLocked()
+}
+
+func (sw *SecureWriter) flushLocked() error {
+	if sw.timer != nil {
+		sw.timer.Stop()
+		sw.timer = nil
+	}
+	if len(sw.pending) == 0 {
+		return sw.err
+	}
+	err := sw.writeFrame(sw.pending, 0)
+	sw.pending = sw.pending[:0]
+	return err
+}
+
+// close makes a last attempt to send anything buffered, then closes c,
+// the connection sw writes to. The flush timer is stopped so it can't
+// fire once the connection is gone, and writes fail from then on.
+//
+// A writer holding the lock may be stuck on a peer that stopped
+// reading, so in that case c is closed first to free it, and anything
+// buffered is dropped.
+func (sw *SecureWriter) close(c net.Conn) error {
+	if !sw.mu.TryLock() {
+		err := c.Close()
+		sw.mu.Lock()
+		sw.shutLocked()
+		sw.mu.Unlock()
+		return err
+	}
+
+	if len(sw.pending) > 0 {
+		c.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+		sw.flushLocked()
+	}
+	sw.shutLocked()
+	sw.mu.Unlock()
+	return c.Close()
+}
+
+func (sw *SecureWriter) shutLocked() {
+	if sw.timer != nil {
+		sw.timer.Stop()
+		sw.timer = nil
+	}
+	sw.pending = sw.pending[:0]
+	if sw.err == nil {
+		sw.err = net.ErrClosed
+	}
+}
+
+// sentPrefix reports whether prefix is the random part of this
+// stream's nonces. It may be called without holding mu.
+func (sw *SecureWriter) sentPrefix(prefix []byte) bool {
+	nonce := sw.nonce.Load()
+	return nonce != nil && bytes.Equal(nonce[1:16], prefix)
+}
+
+// writeClose tells the peer why the connection is being dropped, in a
+// sealed frame so that nobody else can forge one. Anything still
+// buffered is thrown away.
+func (sw *SecureWriter) writeClose(reason string) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if len(reason) > maxErrorReasonSize {
+		reason = reason[:maxErrorReasonSize]
+	}
+	if len(reason) > sw.maxFrameSize {
+		reason = reason[:sw.maxFrameSize]
+	}
+	sw.pending = sw.pending[:0]
+	return sw.writeFrame([]byte(reason), frameClose)
+}
+
+func (sw *SecureWriter) writeFrame(message []byte, flags byte) error {
+	// A frame that was only partly written can't be taken back,
+	// so the stream is broken from then on
+	if sw.err != nil {
+		return sw.err
+	}
+
+	// Pick a random prefix for this stream's nonces on the first write
+	if sw.nonce.Load() == nil {
+		nonce, err := randomNonce()
+		if err != nil {
+			return err
+		}
+		nonce[0] = sw.direction
+		sw.nonce.Store(nonce)
+	}
+
+	// Number the frame, so the reader can tell if it arrives out of order
+	nonce := *sw.nonce.Load()
+	nonce[0] |= flags
+	setNonceSequence(&nonce, sw.seq)
+	sw.seq++
+
+	// Convert message to encrypted byte slice with nonce, after room for
+	// the payload size, reusing the same buffer for every frame
+	if sw.buf == nil {
+		sw.buf = make([]byte, 4, 4+sw.maxFrameSize+frameOverhead)
+	}
+	frame := append(sw.buf[:4], nonce[:]...)
+	frame = box.SealAfterPrecomputation(frame, message, &nonce, sw.sharedKey)
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(frame)-4))
+
+	// Write the whole frame at once, so a failed write never leaves
+	// half a header on the wire
+	_, err := sw.w.Write(frame)
 	if err != nil {
-		log.Println("Error writing encrypted message to buffer", err)
-		return 0, err
+		sw.err = err
+		return err
 	}
 
-	return len(message), nil
+	sw.bytesWritten.Add(int64(len(message)))
+	sw.wireBytesWritten.Add(int64(len(frame)))
+	sw.framesWritten.Add(1)
+	if sw.observe != nil {
+		sw.observe(len(message))
+	}
+	return nil
+}
+
+// writeErrorFrame tells the peer why the handshake failed. It is sent
+// in the clear, in place of a handshake message, as there may be no
+// keys yet to seal it with. Once connected, see writeClose instead:
+//   message = | 0xFFFFFFFF | 4-byte little-endian uint32 for reason size | reason |
+func writeErrorFrame(w io.Writer, reason string) error {
+	if len(reason) > maxErrorReasonSize {
+		reason = reason[:maxErrorReasonSize]
+	}
+	buf := make([]byte, 8+len(reason))
+	binary.LittleEndian.PutUint32(buf[0:4], errorFrameMarker)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(reason)))
+	copy(buf[8:], reason)
+	_, err := w.Write(buf)
+	return err
 }
 
 func randomNonce() (*[24]byte, error) {
 	var buf [24]byte
 	_, err := rand.Read(buf[:])
 	if err != nil {
-		log.Println("Error generating nonce:", err)
 		return nil, err
 	}
 	return &buf, nil
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrServerClosed is returned by Server.Serve after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("server closed")
+
+// A Server accepts encrypted connections and hands them to
+// Config.Handler. Unlike Serve, it can be stopped cleanly.
+type Server struct {
+	Config *Config
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[*EncryptedConnection]struct{}
+	active    sync.WaitGroup
+	stats     serverStats
+}
+
+// Serve accepts connections on l until it fails, or the server is shut
+// down, in which case it returns ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	el := newListener(l, s.Config, &s.stats)
+	if !s.trackListener(el, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(el, false)
+
+	handler := s.Config.handler()
+	for {
+		// Wait for a client to complete the handshake.
+		conn, err := el.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		// Handle the connection in a new goroutine.
+		ec := conn.(*EncryptedConnection)
+		if !s.trackConn(ec) {
+			ec.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.untrackConn(ec)
+			handleConnection(ec, handler)
+		}()
+	}
+}
+
+// Stats returns counts of what happened to the server's connections so far.
+func (s *Server) Stats() ServerStats {
+	return s.stats.snapshot()
+}
+
+// Shutdown stops accepting connections, and waits for the active ones
+// to finish. If ctx is done first, the remaining connections are
+// closed and its error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.closeConns()
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting connections, and closes the active ones
+// straight away.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+	s.closeConns()
+	return err
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.closed {
+			return false
+		}
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) trackConn(ec *EncryptedConnection) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*EncryptedConnection]struct{})
+	}
+	s.conns[ec] = struct{}{}
+	s.active.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(ec *EncryptedConnection) {
+	s.mu.Lock()
+	delete(s.conns, ec)
+	s.mu.Unlock()
+	s.active.Done()
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, l)
+	}
+	return err
+}
+
+// closeConns closes the active connections without holding mu,
+// as closing one runs Hooks.OnClose, which may call back into s.
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	conns := make([]*EncryptedConnection, 0, len(s.conns))
+	for ec := range s.conns {
+		conns = append(conns, ec)
+	}
+	s.mu.Unlock()
+
+	for _, ec := range conns {
+		ec.Close()
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ServerStats counts what happened to the connections a server accepted.
+type ServerStats struct {
+	Accepted          int64 // connections accepted
+	HandshakeFailures int64 // handshakes that failed, other than by timing out
+	HandshakeTimeouts int64 // clients that took too long to complete the handshake
+	IdleTimeouts      int64 // clients dropped for sending nothing for too long
+}
+
+// serverStats is the live, concurrently updated version of ServerStats.
+type serverStats struct {
+	accepted          atomic.Int64
+	handshakeFailures atomic.Int64
+	handshakeTimeouts atomic.Int64
+	idleTimeouts      atomic.Int64
+}
+
+func (s *serverStats) snapshot() ServerStats {
+	return ServerStats{
+		Accepted:          s.accepted.Load(),
+		HandshakeFailures: s.handshakeFailures.Load(),
+		HandshakeTimeouts: s.handshakeTimeouts.Load(),
+		IdleTimeouts:      s.idleTimeouts.Load(),
+	}
+}
+
+// ConnStats describes what a connection has transferred so far.
+// Wire counts include the framing and encryption overhead.
+type ConnStats struct {
+	BytesSent         int64         // data written, before encryption
+	BytesReceived     int64         // data read, after decryption
+	WireBytesSent     int64         // bytes sent over the underlying connection
+	WireBytesReceived int64         // bytes of frames received, whether or not they decrypted
+	FramesSent        int64         // frames written
+	FramesReceived    int64         // frames that decrypted
+	DecryptFailures   int64         // frames that failed authentication
+	HandshakeDuration time.Duration // zero without a handshake
+	Age               time.Duration // time since the connection was set up
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}